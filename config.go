@@ -1,76 +1,500 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"go.yaml.in/yaml/v3"
+
 	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
 )
 
 type config struct {
-	addr             string
-	path             string
-	netns            []string
-	prefix           string
-	quiet            bool
-	timeoutGathering time.Duration
-	timeoutShutdown  time.Duration
-	timeoutHTTP      time.Duration
-	fixMetricNames   bool
-	logf             func(string, ...any)
+	configFile        string
+	enableLifecycle   bool
+	webConfigFile     string
+	addr              string
+	path              string
+	netns             netnsFlag
+	discovery         bool
+	discoveryProc     bool
+	discoveryInterval time.Duration
+	prefix            string
+	quiet             bool
+	timeoutGathering  time.Duration
+	timeoutNetns      time.Duration
+	parallelism       int
+	pollInterval      time.Duration
+	coalesce          bool
+	timeoutShutdown   time.Duration
+	timeoutHTTP       time.Duration
+	fixMetricNames    bool
+	openMetrics       bool
+	source            string
+	aggregation       string
+	metricsInclude    string
+	metricsExclude    string
+	labels            labelsFlag
+	errorsPath        string
+	errorHistory      int
+	logFormat         string
+	logLevel          slog.Level
+	logger            *slog.Logger
+	printConfig       bool
+
+	// flags are bound to the fields of the config as loaded.
+	flags *flag.FlagSet
+
+	// origins are where the value of each flag came from.
+	origins map[string]string
+}
+
+// The origins of the values of the flags, from highest to lowest precedence.
+const (
+	originFlag    = "flag"
+	originEnv     = "env"
+	originFile    = "file"
+	originDefault = "default"
+)
+
+// envPrefix is the prefix of the environment variables equivalent to the
+// flags, see envName.
+const envPrefix = "CONNTRACK_STATS_EXPORTER_"
+
+// configure returns the configuration of the flags and of the configuration
+// file, if any, along with the options of the exporter.  It exits on invalid
+// settings.
+func configure(ctx context.Context) (config, []exporter.Option) {
+	c, err := load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.printConfig {
+		if err := c.print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	if !c.quiet {
+		opts := &slog.HandlerOptions{Level: c.logLevel}
+
+		switch c.logFormat {
+		case "text":
+			c.logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+		case "json":
+			c.logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+		default:
+			log.Fatalf("invalid -log-format %q, must be text or json", c.logFormat)
+		}
+	}
+
+	opts, err := c.options(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return c, opts
 }
 
-func configure() (config, []exporter.Option) {
+// load parses the flags, the environment variables equivalent to the flags
+// and the configuration file, if any.  Flags set on the command line take
+// precedence over the environment, which takes precedence over the
+// configuration file.  The environment is looked up by lookupEnv.
+func load(args []string, lookupEnv func(string) (string, bool)) (config, error) {
 	// default values
 	c := config{
-		addr:             ":9371",
-		path:             "/metrics",
-		prefix:           "conntrack_stats",
-		quiet:            false,
-		timeoutGathering: time.Second * 5,
-		timeoutShutdown:  time.Second * 3,
-		timeoutHTTP:      time.Second * 10,
-		fixMetricNames:   false,
-		logf:             func(string, ...any) {},
-	}
-
-	var (
-		tmpNetns string
-	)
+		addr:              ":9371",
+		path:              "/metrics",
+		prefix:            "conntrack_stats",
+		quiet:             false,
+		timeoutGathering:  time.Second * 5,
+		timeoutNetns:      0,
+		parallelism:       4,
+		pollInterval:      0,
+		coalesce:          false,
+		timeoutShutdown:   time.Second * 3,
+		timeoutHTTP:       time.Second * 10,
+		fixMetricNames:    false,
+		openMetrics:       false,
+		discovery:         false,
+		discoveryProc:     false,
+		discoveryInterval: time.Second * 30,
+		source:            "conntrack",
+		labels:            labelsFlag{},
+		errorsPath:        "",
+		errorHistory:      10,
+		aggregation:       exporter.AggregatePerCPU.String(),
+		logFormat:         "text",
+		logLevel:          slog.LevelInfo,
+		logger:            slog.New(slog.DiscardHandler),
+		netns:             netnsFlag{""},
+		origins:           make(map[string]string),
+	}
 
-	var fs = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var fs = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
+	c.flags = fs
+
+	fs.StringVar(&c.configFile, "config.file", c.configFile, "YAML configuration file, reloaded on SIGHUP")
+	fs.BoolVar(
+		&c.enableLifecycle, "web.enable-lifecycle", c.enableLifecycle,
+		"reload -config.file on POST to /-/reload as well",
+	)
+	fs.StringVar(
+		&c.webConfigFile, "web.config.file", c.webConfigFile,
+		"web configuration file of TLS and basic auth in the format of the Prometheus exporter-toolkit, "+
+			"reloaded when it or the certificates change",
+	)
 	fs.StringVar(&c.path, "path", c.path, "metrics endpoint path")
 	fs.StringVar(&c.addr, "addr", c.addr, "TCP address to listen on")
 	fs.StringVar(&c.prefix, "prefix", c.prefix, "metrics prefix")
 	fs.BoolVar(&c.quiet, "quiet", c.quiet, "don't log anything")
+	fs.StringVar(&c.logFormat, "log-format", c.logFormat, "log format: text or json")
+	fs.TextVar(&c.logLevel, "log-level", c.logLevel, "log level: debug, info, warn or error")
 	fs.DurationVar(&c.timeoutGathering, "timeout-gathering", c.timeoutGathering, "timeout for gathering metrics")
+	fs.DurationVar(&c.timeoutNetns, "timeout-netns", c.timeoutNetns, "timeout for gathering metrics of a single netns")
+	fs.IntVar(&c.parallelism, "parallelism", c.parallelism, "maximum number of netns gathered concurrently")
+	fs.DurationVar(
+		&c.pollInterval, "poll-interval", c.pollInterval,
+		"gather metrics in the background at this interval instead of on every scrape, 0 disables",
+	)
+	fs.BoolVar(&c.coalesce, "coalesce", c.coalesce, "serve concurrent scrapes by a single gathering of metrics")
 	fs.DurationVar(&c.timeoutShutdown, "timeout-shutdown", c.timeoutShutdown, "timeout for graceful shutdown")
 	fs.DurationVar(&c.timeoutHTTP, "timeout-http", c.timeoutHTTP, "timeout for HTTP requests")
 	fs.BoolVar(&c.fixMetricNames, "fix-metric-names", c.fixMetricNames, "fix historic metric name choices")
-	fs.StringVar(&tmpNetns, "netns", "", "List of netns names separated by comma")
+	fs.BoolVar(
+		&c.openMetrics, "openmetrics", c.openMetrics,
+		"serve OpenMetrics if preferred by the scraper, which renames counters to *_total unless -fix-metric-names",
+	)
+	fs.Var(
+		&c.netns, "netns",
+		"List of netns separated by comma, each a netns name or [label=](name|path|pid):netns",
+	)
+	fs.BoolVar(&c.discovery, "netns-discovery", c.discovery, "discover named netns in /run/netns (see ip-netns(8))")
+	fs.BoolVar(&c.discoveryProc, "netns-discovery-proc", c.discoveryProc, "discover the netns of all processes in /proc")
+	fs.DurationVar(
+		&c.discoveryInterval, "netns-discovery-interval", c.discoveryInterval,
+		"interval of netns discovery, 0 is every scrape",
+	)
+	fs.StringVar(&c.source, "source", c.source, "source of the conntrack statistics: conntrack (tool), procfs or netlink")
 
-	_ = fs.Parse(os.Args[1:])
+	fs.StringVar(
+		&c.aggregation, "aggregation", c.aggregation,
+		"expose the per-CPU counters per-cpu, as sum over all CPUs, or both",
+	)
 
-	c.netns = strings.Split(tmpNetns, ",")
+	fs.StringVar(
+		&c.metricsInclude, "metrics-include", c.metricsInclude,
+		"regex of the short names of the metrics to expose, e.g. drop|insert_failed",
+	)
+	fs.StringVar(
+		&c.metricsExclude, "metrics-exclude", c.metricsExclude,
+		"regex of the short names of the metrics not to expose, e.g. found|search_restart",
+	)
 
-	if !c.quiet {
-		c.logf = log.New(os.Stderr, "", 0).Printf
+	fs.Var(
+		c.labels, "label",
+		"constant label key=value added to every sample, may be repeated; $VAR and ${VAR} in the value are expanded",
+	)
+
+	fs.StringVar(
+		&c.errorsPath, "errors-path", c.errorsPath,
+		"endpoint path of the last scrape errors of each netns as JSON, e.g. /debug/scrape-errors; "+
+			"empty disables, since the errors reveal netns paths, pids and the stderr of the tool",
+	)
+	fs.IntVar(&c.errorHistory, "error-history", c.errorHistory, "number of scrape errors retained per netns")
+
+	fs.BoolVar(
+		&c.printConfig, "print-config", c.printConfig,
+		"print the configuration and where each value came from, then exit",
+	)
+
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		_, _ = fmt.Fprintf(
+			fs.Output(),
+			"\nEvery flag may be set by an environment variable as well, e.g. %s for -timeout-netns.  "+
+				"Repeated flags take a list separated by comma.\n"+
+				"Flags take precedence over the environment, which takes precedence over -config.file.\n",
+			envName("timeout-netns"),
+		)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	fs.VisitAll(func(f *flag.Flag) { c.origins[f.Name] = originDefault })
+	fs.Visit(func(f *flag.Flag) { c.origins[f.Name] = originFlag })
+
+	var errs []error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		if !ok || c.origins[f.Name] == originFlag {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := f.Value.(labelsFlag); ok {
+			values = strings.Split(value, ",")
+		}
+
+		for _, v := range values {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err))
+
+				return
+			}
+		}
+
+		c.origins[f.Name] = originEnv
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		return c, err
+	}
+
+	if c.configFile != "" {
+		if err := c.readFile(); err != nil {
+			return c, fmt.Errorf("error reading -config.file: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// envName returns the name of the environment variable equivalent to a flag,
+// e.g. CONNTRACK_STATS_EXPORTER_TIMEOUT_NETNS for timeout-netns.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+// print writes the value of each flag and where it came from.
+func (c config) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "FLAG\tVALUE\tORIGIN")
+
+	c.flags.VisitAll(func(f *flag.Flag) {
+		origin := c.origins[f.Name]
+		if origin == originEnv {
+			origin += " " + envName(f.Name)
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s\t%q\t%s\n", f.Name, f.Value.String(), origin)
+	})
+
+	return tw.Flush()
+}
+
+// options validates the settings and returns the options of the exporter.
+func (c config) options(ctx context.Context) ([]exporter.Option, error) {
+	if err := exporter.CheckNetNs(c.netns); err != nil {
+		return nil, fmt.Errorf("invalid netns: %w", err)
+	}
+
+	if err := exporter.CheckConstLabels(c.labels); err != nil {
+		return nil, fmt.Errorf("invalid label: %w", err)
 	}
 
 	opts := []exporter.Option{
 		exporter.WithNetNs(c.netns),
 		exporter.WithTimeout(c.timeoutGathering),
+		exporter.WithNetnsTimeout(c.timeoutNetns),
+		exporter.WithParallelism(c.parallelism),
 		exporter.WithPrefix(c.prefix),
-		exporter.WithErrorLogger(c.logf),
+		exporter.WithLogger(c.logger),
+		exporter.WithConstLabels(c.labels),
+		exporter.WithErrorHistory(c.errorHistory),
 	}
 
 	if c.fixMetricNames {
 		opts = append(opts, exporter.WithFixMetricNames())
 	}
 
-	return c, opts
+	if c.pollInterval > 0 {
+		opts = append(opts, exporter.WithPolling(ctx, c.pollInterval))
+	}
+
+	if c.coalesce {
+		opts = append(opts, exporter.WithCoalescing())
+	}
+
+	if c.openMetrics {
+		opts = append(opts, exporter.WithOpenMetrics())
+	}
+
+	if c.discovery {
+		opts = append(opts, exporter.WithNetnsDiscovery(c.discoveryInterval))
+	}
+
+	if c.discoveryProc {
+		opts = append(opts, exporter.WithProcNetnsDiscovery(c.discoveryInterval))
+	}
+
+	switch c.source {
+	case "conntrack":
+	case "procfs":
+		opts = append(opts, exporter.WithProcfs())
+	case "netlink":
+		opts = append(opts, exporter.WithNetlink())
+	default:
+		return nil, fmt.Errorf("unknown source %q", c.source)
+	}
+
+	aggregation, err := exporter.ParseAggregation(c.aggregation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid aggregation: %w", err)
+	}
+
+	opts = append(opts, exporter.WithAggregation(aggregation))
+
+	var include, exclude *regexp.Regexp
+
+	if c.metricsInclude != "" {
+		if include, err = regexp.Compile(c.metricsInclude); err != nil {
+			return nil, fmt.Errorf("invalid metrics-include: %w", err)
+		}
+	}
+
+	if c.metricsExclude != "" {
+		if exclude, err = regexp.Compile(c.metricsExclude); err != nil {
+			return nil, fmt.Errorf("invalid metrics-exclude: %w", err)
+		}
+	}
+
+	opts = append(opts, exporter.WithMetricFilter(include, exclude))
+
+	return opts, nil
+}
+
+// readFile reads the configuration file.  The settings of flags set on the
+// command line or by the environment are kept.
+func (c *config) readFile() error {
+	f, err := os.Open(c.configFile)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var file fileConfig
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	fromFile(c.origins, "addr", &c.addr, file.Addr)
+	fromFile(c.origins, "path", &c.path, file.Path)
+	fromFile(c.origins, "netns", &c.netns, file.Netns)
+	fromFile(c.origins, "netns-discovery", &c.discovery, file.Discovery)
+	fromFile(c.origins, "netns-discovery-proc", &c.discoveryProc, file.DiscoveryProc)
+	fromFile(c.origins, "netns-discovery-interval", &c.discoveryInterval, file.DiscoveryInterval)
+	fromFile(c.origins, "timeout-gathering", &c.timeoutGathering, file.TimeoutGathering)
+	fromFile(c.origins, "timeout-netns", &c.timeoutNetns, file.TimeoutNetns)
+	fromFile(c.origins, "timeout-shutdown", &c.timeoutShutdown, file.TimeoutShutdown)
+	fromFile(c.origins, "timeout-http", &c.timeoutHTTP, file.TimeoutHTTP)
+	fromFile(c.origins, "metrics-include", &c.metricsInclude, file.MetricsInclude)
+	fromFile(c.origins, "metrics-exclude", &c.metricsExclude, file.MetricsExclude)
+
+	if file.Labels != nil && c.origins["label"] == originDefault {
+		for key, value := range file.Labels {
+			c.labels[key] = os.ExpandEnv(value)
+		}
+
+		c.origins["label"] = originFile
+	}
+
+	return nil
+}
+
+// fileConfig are the settings of the configuration file, named like the
+// flags.  Settings left out keep the value of the flag.
+type fileConfig struct {
+	Addr              *string           `yaml:"addr"`
+	Path              *string           `yaml:"path"`
+	Netns             *netnsFlag        `yaml:"netns"`
+	Discovery         *bool             `yaml:"netns-discovery"`
+	DiscoveryProc     *bool             `yaml:"netns-discovery-proc"`
+	DiscoveryInterval *time.Duration    `yaml:"netns-discovery-interval"`
+	Labels            map[string]string `yaml:"labels"`
+	TimeoutGathering  *time.Duration    `yaml:"timeout-gathering"`
+	TimeoutNetns      *time.Duration    `yaml:"timeout-netns"`
+	TimeoutShutdown   *time.Duration    `yaml:"timeout-shutdown"`
+	TimeoutHTTP       *time.Duration    `yaml:"timeout-http"`
+	MetricsInclude    *string           `yaml:"metrics-include"`
+	MetricsExclude    *string           `yaml:"metrics-exclude"`
+}
+
+// fromFile sets *dst to the value of the file, unless the file leaves it out
+// or the flag is set on the command line or by the environment.
+func fromFile[T any](origins map[string]string, name string, dst, value *T) {
+	if value != nil && origins[name] == originDefault {
+		*dst = *value
+		origins[name] = originFile
+	}
+}
+
+// labelsFlag is a repeatable flag of labels as key=value, with the environment
+// variables in the value expanded.
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	labels := make([]string, 0, len(l))
+	for key, value := range l {
+		labels = append(labels, key+"="+value)
+	}
+
+	slices.Sort(labels)
+
+	return strings.Join(labels, ",")
+}
+
+func (l labelsFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("label %q is not key=value", s)
+	}
+
+	if _, ok := l[key]; ok {
+		return fmt.Errorf("label %q is set twice", key)
+	}
+
+	l[key] = os.ExpandEnv(value)
+
+	return nil
+}
+
+// netnsFlag is a flag of a list of netns separated by comma.
+type netnsFlag []string
+
+func (n *netnsFlag) String() string { return strings.Join(*n, ",") }
+
+func (n *netnsFlag) Set(s string) error {
+	*n = strings.Split(s, ",")
+
+	return nil
 }
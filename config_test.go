@@ -0,0 +1,354 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+// noEnv is an empty environment.
+func noEnv(string) (string, bool) { return "", false }
+
+// fakeEnv returns a lookup of the environment env.
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+
+		return value, ok
+	}
+}
+
+// writeFile writes content to the file name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Setenv("TEST_NODE", "n1")
+
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+addr: ":1234"
+path: /custom
+netns: ["", "blue"]
+netns-discovery: true
+netns-discovery-interval: 1m
+labels:
+  node: ${TEST_NODE}
+timeout-gathering: 7s
+metrics-include: drop|count
+`)
+
+	c, err := load([]string{"-config.file", path, "-addr", ":4321"}, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.addr != ":4321" {
+		t.Errorf("expected the flag to take precedence over the file, got addr %q", c.addr)
+	}
+
+	if c.path != "/custom" || !slices.Equal(c.netns, []string{"", "blue"}) || !c.discovery ||
+		c.discoveryInterval != time.Minute || c.timeoutGathering != 7*time.Second || c.metricsInclude != "drop|count" {
+		t.Errorf("expected the settings of the file, got %+v", c)
+	}
+
+	if c.labels["node"] != "n1" {
+		t.Errorf("expected the label node=n1 with the environment variable expanded, got %v", c.labels)
+	}
+
+	if c.timeoutHTTP != 10*time.Second {
+		t.Errorf("expected the default of a setting left out, got timeout-http %s", c.timeoutHTTP)
+	}
+
+	if _, err := c.options(t.Context()); err != nil {
+		t.Errorf("expected a valid configuration, got %v", err)
+	}
+}
+
+func TestConfigFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"unknown setting", "bogus: 1\n"},
+		{"wrong type", "netns-discovery: maybe\n"},
+		{"invalid duration", "timeout-gathering: soon\n"},
+		{"invalid netns", "netns: [\"x=pid:0\"]\n"},
+		{"invalid label", "labels: {netns: x}\n"},
+		{"invalid regex", "metrics-include: \"(\"\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeFile(t, dir, "config.yaml", tc.content)
+
+			c, err := load([]string{"-config.file", path}, noEnv)
+			if err == nil {
+				_, err = c.options(t.Context())
+			}
+
+			if err == nil {
+				t.Error("expected an error, got none")
+			}
+		})
+	}
+
+	if _, err := load([]string{"-config.file", filepath.Join(dir, "missing.yaml")}, noEnv); err == nil {
+		t.Error("expected an error for a missing file, got none")
+	}
+
+	path := writeFile(t, dir, "empty.yaml", "")
+	if _, err := load([]string{"-config.file", path}, noEnv); err != nil {
+		t.Errorf("expected an empty file to be valid, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	var (
+		path = writeFile(t, t.TempDir(), "config.yaml", "labels: {site: a}\n")
+		args = []string{"-config.file", path, "-source", "procfs"}
+	)
+
+	c, err := load(args, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := c.options(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		exp = exporter.New(opts...)
+		r   = &reloader{ctx: t.Context(), exp: exp, args: args, lookupEnv: noEnv, started: c}
+	)
+
+	post := func(method string) int {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), method, "/-/reload", http.NoBody))
+
+		return recorder.Code
+	}
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		exp.ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody))
+
+		return recorder.Body.String()
+	}
+
+	if body := scrape(); !strings.Contains(body, `site="a"`) {
+		t.Fatalf("expected the label site=a, got:\n%s", body)
+	}
+
+	writeFile(t, filepath.Dir(path), "config.yaml", "labels: {site: b}\nnetns: [\"\", \"x=path:/nonexistent\"]\n")
+
+	if code := post(http.MethodPost); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+
+	body := scrape()
+	if !strings.Contains(body, `site="b"`) || !strings.Contains(body, `netns="x"`) {
+		t.Errorf("expected the label site=b and netns x after the reload, got:\n%s", body)
+	}
+
+	writeFile(t, filepath.Dir(path), "config.yaml", "labels: {netns: c}\n")
+
+	if code := post(http.MethodPost); code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for an invalid file, got %d", code)
+	}
+
+	if body := scrape(); !strings.Contains(body, `site="b"`) {
+		t.Errorf("expected the previous configuration to be kept, got:\n%s", body)
+	}
+
+	if code := post(http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", code)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", "addr: \":3\"\nlabels: {site: file}\nnetns-discovery: false\n")
+
+	for _, tc := range []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		wantAddr     string
+		wantOrigin   string
+		wantLabels   string
+		wantLabelsOf string
+	}{
+		{
+			name:       "default",
+			wantAddr:   ":9371",
+			wantOrigin: originDefault,
+		},
+		{
+			name:         "file over default",
+			args:         []string{"-config.file", path},
+			wantAddr:     ":3",
+			wantOrigin:   originFile,
+			wantLabels:   "site=file",
+			wantLabelsOf: originFile,
+		},
+		{
+			name:         "env over file",
+			env:          map[string]string{"CONNTRACK_STATS_EXPORTER_CONFIG_FILE": path, "CONNTRACK_STATS_EXPORTER_ADDR": ":2"},
+			wantAddr:     ":2",
+			wantOrigin:   originEnv,
+			wantLabels:   "site=file",
+			wantLabelsOf: originFile,
+		},
+		{
+			name:         "flag over env",
+			args:         []string{"-config.file", path, "-addr", ":1"},
+			env:          map[string]string{"CONNTRACK_STATS_EXPORTER_ADDR": ":2"},
+			wantAddr:     ":1",
+			wantOrigin:   originFlag,
+			wantLabels:   "site=file",
+			wantLabelsOf: originFile,
+		},
+		{
+			name:         "env labels separated by comma",
+			args:         []string{"-config.file", path},
+			env:          map[string]string{"CONNTRACK_STATS_EXPORTER_LABEL": "a=1,b=2"},
+			wantAddr:     ":3",
+			wantOrigin:   originFile,
+			wantLabels:   "a=1,b=2",
+			wantLabelsOf: originEnv,
+		},
+		{
+			name:         "flag labels over env",
+			args:         []string{"-label", "c=3"},
+			env:          map[string]string{"CONNTRACK_STATS_EXPORTER_LABEL": "a=1,b=2"},
+			wantAddr:     ":9371",
+			wantOrigin:   originDefault,
+			wantLabels:   "c=3",
+			wantLabelsOf: originFlag,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := load(tc.args, fakeEnv(tc.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.addr != tc.wantAddr || c.origins["addr"] != tc.wantOrigin {
+				t.Errorf("expected addr %q from %s, got %q from %s", tc.wantAddr, tc.wantOrigin, c.addr, c.origins["addr"])
+			}
+
+			if tc.wantLabelsOf == "" {
+				tc.wantLabelsOf = originDefault
+			}
+
+			if c.labels.String() != tc.wantLabels || c.origins["label"] != tc.wantLabelsOf {
+				t.Errorf(
+					"expected labels %q from %s, got %q from %s",
+					tc.wantLabels, tc.wantLabelsOf, c.labels.String(), c.origins["label"],
+				)
+			}
+		})
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	c, err := load(nil, fakeEnv(map[string]string{
+		"CONNTRACK_STATS_EXPORTER_NETNS_DISCOVERY":   "true",
+		"CONNTRACK_STATS_EXPORTER_TIMEOUT_NETNS":     "2s",
+		"CONNTRACK_STATS_EXPORTER_NETNS":             ",blue",
+		"CONNTRACK_STATS_EXPORTER_WEB_CONFIG_FILE":   "web.yaml",
+		"CONNTRACK_STATS_EXPORTER_UNKNOWN_SETTING":   "ignored",
+		"conntrack_stats_exporter_timeout_gathering": "1s",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.discovery || c.timeoutNetns != 2*time.Second || !slices.Equal(c.netns, []string{"", "blue"}) ||
+		c.webConfigFile != "web.yaml" {
+		t.Errorf("expected the settings of the environment, got %+v", c)
+	}
+
+	if c.timeoutGathering != 5*time.Second || c.origins["timeout-gathering"] != originDefault {
+		t.Errorf("expected the names of the environment variables to be case-sensitive, got %s", c.timeoutGathering)
+	}
+
+	for _, env := range []map[string]string{
+		{"CONNTRACK_STATS_EXPORTER_TIMEOUT_NETNS": "soon"},
+		{"CONNTRACK_STATS_EXPORTER_NETNS_DISCOVERY": "maybe"},
+		{"CONNTRACK_STATS_EXPORTER_LABEL": "a=1,b"},
+		{"CONNTRACK_STATS_EXPORTER_LOG_LEVEL": "loud"},
+	} {
+		if _, err := load(nil, fakeEnv(env)); err == nil {
+			t.Errorf("expected an error for %v, got none", env)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", "path: /file\n")
+
+	c, err := load(
+		[]string{"-config.file", path, "-print-config", "-prefix", "p"},
+		fakeEnv(map[string]string{"CONNTRACK_STATS_EXPORTER_ADDR": ":2"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.printConfig {
+		t.Error("expected -print-config to be set")
+	}
+
+	var buf strings.Builder
+
+	if err := c.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`(?m)^FLAG +VALUE +ORIGIN$`,
+		`(?m)^prefix +"p" +flag$`,
+		`(?m)^addr +":2" +env CONNTRACK_STATS_EXPORTER_ADDR$`,
+		`(?m)^path +"/file" +file$`,
+		`(?m)^timeout-http +"10s" +default$`,
+	} {
+		if !regexp.MustCompile(want).MatchString(buf.String()) {
+			t.Errorf("expected %s, got:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import "fmt"
+
+// Aggregation sets whether the per-CPU counters are exposed per CPU, summed
+// over all CPUs, or both.
+type Aggregation int
+
+const (
+	// AggregatePerCPU exposes the counters per CPU with a cpu label.  This is
+	// the default.
+	AggregatePerCPU Aggregation = iota
+
+	// AggregateSum exposes only the sums of the counters over all CPUs, named
+	// with the suffix _all_cpus, e.g. conntrack_stats_drop_all_cpus.
+	AggregateSum
+
+	// AggregateBoth exposes the counters per CPU and their sums.
+	AggregateBoth
+)
+
+// WithAggregation sets how the per-CPU counters are aggregated.
+func WithAggregation(aggregation Aggregation) Option {
+	return func(cfg *config) { cfg.aggregation = aggregation }
+}
+
+// ParseAggregation parses an Aggregation as printed by its String method.
+func ParseAggregation(s string) (Aggregation, error) {
+	for _, aggregation := range []Aggregation{AggregatePerCPU, AggregateSum, AggregateBoth} {
+		if s == aggregation.String() {
+			return aggregation, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid aggregation %q, must be per-cpu, sum or both", s)
+}
+
+func (a Aggregation) String() string {
+	switch a {
+	case AggregatePerCPU:
+		return "per-cpu"
+	case AggregateSum:
+		return "sum"
+	case AggregateBoth:
+		return "both"
+	default:
+		return fmt.Sprintf("Aggregation(%d)", int(a))
+	}
+}
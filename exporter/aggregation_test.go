@@ -0,0 +1,88 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestAggregation(t *testing.T) {
+	var (
+		perCPU = []string{
+			`conntrack_stats_insert_failed{cpu="0",netns=""} 17`,
+			`conntrack_stats_insert_failed{cpu="1",netns=""} 23`,
+			`conntrack_stats_drop{cpu="0",netns=""} 4`,
+		}
+		sum = []string{
+			`# HELP conntrack_stats_insert_failed_all_cpus Total of conntrack insert_failed, summed over all CPUs`,
+			`# TYPE conntrack_stats_insert_failed_all_cpus counter`,
+			`conntrack_stats_insert_failed_all_cpus{netns=""} 40`,
+			`conntrack_stats_drop_all_cpus{netns=""} 4`,
+		}
+	)
+
+	for _, tc := range []struct {
+		aggregation     exporter.Aggregation
+		want, wantNot   []string
+		wantCPULabelled bool
+	}{
+		{exporter.AggregatePerCPU, perCPU, sum, true},
+		{exporter.AggregateSum, sum, perCPU, false},
+		{exporter.AggregateBoth, append(perCPU, sum...), nil, true},
+	} {
+		t.Run(tc.aggregation.String(), func(t *testing.T) {
+			aggregation, err := exporter.ParseAggregation(tc.aggregation.String())
+			if err != nil || aggregation != tc.aggregation {
+				t.Errorf("expected to parse %s, got %v, %v", tc.aggregation, aggregation, err)
+			}
+
+			body := scrape(
+				t,
+				exporter.Handler(exporter.WithSource(fakeSource{stats: testStats}), exporter.WithAggregation(aggregation)),
+			)
+
+			checkText(t, body)
+
+			for _, want := range tc.want {
+				if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+					t.Errorf("expected to find %s, but didn't", want)
+				}
+			}
+
+			for _, wantNot := range tc.wantNot {
+				if regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(wantNot) + `$`).Match(body) {
+					t.Errorf("expected not to find %s, but did", wantNot)
+				}
+			}
+
+			if got := regexp.MustCompile(`cpu="`).Match(body); got != tc.wantCPULabelled {
+				t.Errorf("expected cpu labels: %v, got %v", tc.wantCPULabelled, got)
+			}
+
+			if t.Failed() {
+				t.Logf("response:\n%s", string(body))
+			}
+		})
+	}
+
+	if _, err := exporter.ParseAggregation("avg"); err == nil {
+		t.Error("expected an error parsing an invalid aggregation")
+	}
+}
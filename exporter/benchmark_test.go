@@ -44,3 +44,20 @@ type nullResponseWriter struct{}
 func (nullResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
 func (nullResponseWriter) Header() http.Header         { return http.Header{} }
 func (nullResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkManyNetns(b *testing.B) {
+	var (
+		h = exporter.Handler(
+			exporter.WithSource(fakeSource{stats: manyCPUs(128)}),
+			exporter.WithNetNs(manyNetns(100)),
+		)
+		r = httptest.NewRequestWithContext(b.Context(), http.MethodGet, "/", http.NoBody)
+		w nullResponseWriter
+	)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,91 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// WithCoalescing makes concurrent scrapes share the metrics of one gathering:
+// a scrape arriving while the metrics are being gathered for another scrape
+// waits for and is served the same metrics.  This keeps e.g. a pair of
+// Prometheus servers from doubling the load.  The gathering is not canceled
+// when the scrape that started it is gone, so it fails only on timeout.
+func WithCoalescing() Option { return func(cfg *config) { cfg.coalesce = true } }
+
+// flight is the gathering shared by concurrent scrapes.
+type flight struct {
+	done    chan struct{}
+	metrics internal.Metrics
+}
+
+type coalescing struct {
+	mu     sync.Mutex
+	flight *flight
+
+	// coalesced is the number of scrapes served by the flight of another scrape.
+	coalesced atomic.Uint64
+}
+
+// collectCoalesced joins the flight in progress or starts a new one and
+// returns its metrics including the number of coalesced scrapes.  It reports
+// false if ctx is done before the flight lands.
+func (e *exporter) collectCoalesced(ctx context.Context) (internal.Metrics, bool) {
+	e.coalescing.mu.Lock()
+
+	f := e.coalescing.flight
+	if f != nil {
+		e.coalescing.mu.Unlock()
+		e.coalescing.coalesced.Add(1)
+	} else {
+		f = &flight{done: make(chan struct{})}
+		e.coalescing.flight = f
+		e.coalescing.mu.Unlock()
+
+		go func() {
+			f.metrics = e.collect(context.WithoutCancel(ctx))
+
+			e.coalescing.mu.Lock()
+			e.coalescing.flight = nil
+			e.coalescing.mu.Unlock()
+
+			close(f.done)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return internal.Metrics{}, false
+	case <-f.done:
+	}
+
+	// The metrics are shared by all scrapes of the flight.
+	metrics := f.metrics.Clone()
+
+	metrics.GetOrInit(e.cfg.prefix, "counter", "scrape_coalesced").AddCounterSample(
+		nil,
+		strconv.FormatUint(e.coalescing.coalesced.Load(), 10),
+		e.created,
+	)
+
+	return metrics, true
+}
@@ -0,0 +1,105 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+// blockingSource blocks until release is closed.
+type blockingSource struct {
+	calls   atomic.Int64
+	release chan struct{}
+}
+
+func (b *blockingSource) Stats(ctx context.Context, _ string) (exporter.Stats, error) {
+	b.calls.Add(1)
+
+	select {
+	case <-ctx.Done():
+		return exporter.Stats{}, ctx.Err()
+	case <-b.release:
+		return exporter.Stats{Count: 42}, nil
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	const concurrency = 5
+
+	var (
+		src     = &blockingSource{release: make(chan struct{})}
+		handler = exporter.Handler(exporter.WithSource(src), exporter.WithCoalescing())
+		bodies  = make([]string, concurrency)
+		wg      sync.WaitGroup
+	)
+
+	for i := range concurrency {
+		wg.Go(func() {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody))
+			bodies[i] = recorder.Body.String()
+		})
+	}
+
+	// The source blocks the flight until all scrapes joined it.
+	for exporter.CoalescedScrapes(handler) < concurrency-1 {
+		runtime.Gosched()
+	}
+
+	close(src.release)
+	wg.Wait()
+
+	if got := src.calls.Load(); got != 1 {
+		t.Errorf("expected the source to be called once, but was called %d times", got)
+	}
+
+	for _, body := range bodies {
+		for _, regex := range []*regexp.Regexp{
+			regexp.MustCompile(`(?m)^conntrack_stats_count\{netns=""} 42$`),
+			regexp.MustCompile(`(?m)^# TYPE conntrack_stats_scrape_coalesced counter$`),
+			regexp.MustCompile(`(?m)^conntrack_stats_scrape_coalesced 4$`),
+		} {
+			if !regex.MatchString(body) {
+				t.Errorf("expected response to match %s, but didn't", regex)
+			}
+		}
+	}
+
+	// a later scrape starts a new flight
+	body := scrape(t, handler)
+
+	if got := src.calls.Load(); got != 2 {
+		t.Errorf("expected the source to be called twice, but was called %d times", got)
+	}
+
+	if !regexp.MustCompile(`(?m)^conntrack_stats_scrape_coalesced 4$`).Match(body) {
+		t.Errorf("expected the coalesced counter to stay at 4")
+	}
+
+	if t.Failed() {
+		t.Logf("responses:\n%s\n%s", bodies[0], body)
+	}
+}
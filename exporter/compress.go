@@ -0,0 +1,173 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoding is a content coding of the response.
+type encoding struct {
+	name string
+	pool *sync.Pool
+}
+
+// encoder is a pooled compressing writer.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// The encoders are pooled, because they allocate way more memory than the
+// metrics take.  The zstd encoder is configured to stay small, too: the
+// response is a few hundred kB at most.
+var (
+	_gzip = encoding{
+		name: "gzip",
+		pool: &sync.Pool{New: func() any { return gzip.NewWriter(nil) }},
+	}
+
+	_zstd = encoding{
+		name: "zstd",
+		pool: &sync.Pool{
+			New: func() any {
+				enc, err := zstd.NewWriter(
+					nil,
+					zstd.WithEncoderConcurrency(1),
+					zstd.WithWindowSize(1<<20),
+					zstd.WithEncoderLevel(zstd.SpeedDefault),
+					zstd.WithLowerEncoderMem(true),
+				)
+				if err != nil {
+					// the options are constant
+					panic(err)
+				}
+
+				return enc
+			},
+		},
+	}
+)
+
+// negotiateEncoding returns the encoding with the highest quality in the
+// Accept-Encoding header, or nil for the identity encoding.  On equal quality
+// zstd is preferred over gzip.
+func negotiateEncoding(acceptEncoding string) *encoding {
+	var (
+		best  *encoding
+		bestQ = 0.0
+	)
+
+	for coding := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, err := mime.ParseMediaType(coding)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		var enc *encoding
+
+		switch name {
+		case "gzip", "x-gzip":
+			enc = &_gzip
+		case "zstd":
+			enc = &_zstd
+		default:
+			continue
+		}
+
+		if q > bestQ || q == bestQ && q > 0 && enc == &_zstd {
+			best, bestQ = enc, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter compresses what is written to the response, if the
+// response is OK.  The encoder is taken from the pool on the first write.
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding *encoding
+	encoder  encoder
+	compress bool
+	wrote    bool
+}
+
+func (c *compressWriter) WriteHeader(statusCode int) {
+	if !c.wrote {
+		c.wrote = true
+
+		if statusCode == http.StatusOK {
+			c.compress = true
+
+			c.Header().Set("Content-Encoding", c.encoding.name)
+			c.Header().Del("Content-Length")
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wrote {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.compress {
+		return c.ResponseWriter.Write(p)
+	}
+
+	if c.encoder == nil {
+		c.encoder = c.encoding.pool.Get().(encoder) //nolint:forcetypeassert
+		c.encoder.Reset(c.ResponseWriter)
+	}
+
+	return c.encoder.Write(p)
+}
+
+// Close flushes the compressed response and returns the encoder to the pool.
+func (c *compressWriter) Close() error {
+	if c.encoder == nil {
+		return nil
+	}
+
+	err := c.encoder.Close()
+
+	c.encoder.Reset(nil)
+	c.encoding.pool.Put(c.encoder)
+	c.encoder = nil
+
+	return err
+}
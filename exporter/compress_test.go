@@ -0,0 +1,118 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestCompression(t *testing.T) {
+	handler := exporter.Handler(exporter.WithSource(fakeSource{stats: testStats}))
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"br", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"zstd", "zstd"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"gzip;q=1.0, zstd;q=0.5", "gzip"},
+		{"gzip;q=0, zstd;q=0", ""},
+	} {
+		// twice, so pooled encoders are reused
+		for range 2 {
+			request := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+			request.Header.Set("Accept-Encoding", tc.acceptEncoding)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if got := recorder.Header().Get("Content-Encoding"); got != tc.want {
+				t.Errorf("Accept-Encoding: %q: expected Content-Encoding %q, got %q", tc.acceptEncoding, tc.want, got)
+
+				continue
+			}
+
+			body := decompress(t, tc.want, recorder.Body)
+
+			checkText(t, body)
+
+			if want := []byte(`conntrack_stats_count{netns=""} 42`); !bytes.Contains(body, want) {
+				t.Errorf("Accept-Encoding: %q: expected to find %s, but didn't", tc.acceptEncoding, want)
+			}
+		}
+	}
+}
+
+func TestCompressionNotOK(t *testing.T) {
+	request := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/", http.NoBody)
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	recorder := httptest.NewRecorder()
+	exporter.Handler(exporter.WithSource(fakeSource{})).ServeHTTP(recorder, request)
+
+	if got := recorder.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("expected no Content-Encoding, got %q", got)
+	}
+
+	if recorder.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", recorder.Body.String())
+	}
+}
+
+func decompress(t *testing.T, encoding string, r io.Reader) []byte {
+	t.Helper()
+
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r = gr
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer zr.Close()
+
+		r = zr
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
@@ -22,7 +22,7 @@ if [ "${CONNTRACK_STATS_EXPORTER_SLEEP:-}" != "" ]; then
 fi
 
 if [ "${CONNTRACK_STATS_EXPORTER_KAPUTT:-}" = "true" ]; then
-  echo "kaputt"
+  echo "${CONNTRACK_STATS_EXPORTER_KAPUTT_MESSAGE:-kaputt}" >&2
   exit "${CONNTRACK_STATS_EXPORTER_EXIT_CODE:-1}"
 fi
 
@@ -0,0 +1,85 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Exporter serves the metrics like the handler returned by Handler and
+// provides debug handlers sharing its state.  Its configuration can be
+// replaced by Reload.
+type Exporter struct {
+	e atomic.Pointer[exporter]
+
+	// reloading serializes Reload, so every exporter replaced is stopped.
+	reloading sync.Mutex
+}
+
+// New returns an Exporter configured by opts.
+func New(opts ...Option) *Exporter {
+	x := &Exporter{}
+	x.e.Store(newExporter(opts...))
+
+	return x
+}
+
+// ServeHTTP serves the metrics.
+func (x *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) { x.e.Load().ServeHTTP(w, r) }
+
+// WithErrorHistory sets the number of errors retained per netns for
+// ErrorsHandler.  The default is 10; 0 retains none.
+func WithErrorHistory(n int) Option { return func(cfg *config) { cfg.errorHistory = max(n, 0) } }
+
+// ErrorsHandler serves the last errors of each netns as JSON object mapping
+// the netns to its errors, oldest first; netns without errors are left out.
+// The query parameter netns, which may be repeated, selects netns.
+func (x *Exporter) ErrorsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		e := x.e.Load()
+
+		errs := e.scrapeErrors.Errors()
+
+		if selected, ok := r.URL.Query()["netns"]; ok {
+			for netns := range errs {
+				if !slices.Contains(selected, netns) {
+					delete(errs, netns)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(errs); err != nil {
+			e.logger.ErrorContext(r.Context(), "error writing scrape errors to response writer", slog.Any("error", err))
+		}
+	})
+}
@@ -0,0 +1,115 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+type errorRecord struct {
+	Op       string `json:"op"`
+	Message  string `json:"message"`
+	Time     string `json:"time"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func scrapeErrors(t *testing.T, handler http.Handler, query string) map[string][]errorRecord {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/"+query, http.NoBody))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+
+	if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", got)
+	}
+
+	var errs map[string][]errorRecord
+	if err := json.Unmarshal(recorder.Body.Bytes(), &errs); err != nil {
+		t.Fatal(err)
+	}
+
+	return errs
+}
+
+func TestErrorsHandler(t *testing.T) {
+	const history = 3
+
+	exp := exporter.New(
+		exporter.WithSource(fakeSource{err: errors.New("kaputt")}),
+		exporter.WithNetNs([]string{"", "invalid=pid:0"}),
+		exporter.WithErrorHistory(history),
+	)
+
+	if errs := scrapeErrors(t, exp.ErrorsHandler(), ""); len(errs) != 0 {
+		t.Errorf("expected no errors before the first scrape, got %v", errs)
+	}
+
+	for range history + 2 {
+		scrape(t, exp)
+	}
+
+	errs := scrapeErrors(t, exp.ErrorsHandler(), "")
+
+	for netns, want := range map[string]errorRecord{
+		"":        {Op: string(internal.OpSource), Message: "kaputt"},
+		"invalid": {Op: string(internal.OpNetnsPrepare), Message: `invalid netns pid "0"`},
+	} {
+		if len(errs[netns]) != history {
+			t.Errorf("netns %q: expected %d errors, got %d", netns, history, len(errs[netns]))
+
+			continue
+		}
+
+		for i, got := range errs[netns] {
+			if got.Op != want.Op || got.Message != want.Message || got.Time == "" {
+				t.Errorf("netns %q: error %d: expected %+v, got %+v", netns, i, want, got)
+			}
+		}
+	}
+
+	if errs := scrapeErrors(t, exp.ErrorsHandler(), "?netns=invalid"); len(errs) != 1 || errs["invalid"] == nil {
+		t.Errorf("expected only the errors of netns invalid, got %v", errs)
+	}
+}
+
+func TestErrorHistoryDisabled(t *testing.T) {
+	exp := exporter.New(exporter.WithSource(fakeSource{err: errors.New("kaputt")}), exporter.WithErrorHistory(0))
+
+	scrape(t, exp)
+
+	if errs := scrapeErrors(t, exp.ErrorsHandler(), ""); len(errs) != 0 {
+		t.Errorf("expected no errors, got %d", len(errs))
+	}
+
+	body := scrape(t, exp)
+	if want := []byte(`conntrack_stats_scrape_error{netns="",cause="source"} 2`); !bytes.Contains(body, want) {
+		t.Errorf("expected the errors to be counted nonetheless")
+	}
+}
@@ -0,0 +1,336 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// netnsDir is where `ip netns add` bind mounts named netns.  It must be the
+// same directory netns.GetFromName resolves names against.  On most systems
+// /var/run is a link to /run.
+const netnsDir = "/run/netns"
+
+// _procDir is where the proc filesystem is mounted.  Within a container
+// with the hostPID option, /proc shows the processes of the host.
+var _procDir = "/proc"
+
+// hostNetnsPath is the netns of the calling thread, i.e. of the exporter
+// itself unless called within execInNetns.  The netns of /proc/self is the one
+// of the main thread, which may be any thread locked by execInNetns.
+const hostNetnsPath = "/proc/thread-self/ns/net"
+
+// WithNetnsDiscovery makes the exporter discover named netns (see ip-netns(8))
+// in addition to the netns set by WithNetNs.  The netns are discovered at
+// most once per interval when metrics are gathered; an interval of 0
+// discovers them on every scrape.
+func WithNetnsDiscovery(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.discoverNamed = true
+		cfg.discoveryInterval = interval
+	}
+}
+
+// WithProcNetnsDiscovery makes the exporter discover the netns of all
+// processes, so it finds netns that are not named, e.g. those of most
+// container runtimes.  Each netns is gathered only once, labeled with its
+// inode as netns and with the pid, comm and cgroup of the process with the
+// lowest pid in it.  Netns that are also named or set by WithNetNs are left
+// to those.
+//
+// The interval has the same meaning as with WithNetnsDiscovery; if both are
+// used, the last one sets the interval.
+func WithProcNetnsDiscovery(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.discoverProc = true
+		cfg.discoveryInterval = interval
+	}
+}
+
+type discovery struct {
+	mu sync.Mutex
+
+	last    time.Time
+	targets []target
+}
+
+// netnsTargets returns the netns to gather metrics for.  If discovery is
+// enabled and due, it rediscovers the netns and drops the scrape errors of
+// netns that have gone.
+func (e *exporter) netnsTargets() []target {
+	if !e.cfg.discoverNamed && !e.cfg.discoverProc {
+		return e.targets
+	}
+
+	e.discovery.mu.Lock()
+	defer e.discovery.mu.Unlock()
+
+	if e.discovery.targets != nil && time.Since(e.discovery.last) < e.cfg.discoveryInterval {
+		return e.discovery.targets
+	}
+
+	var (
+		targets = slices.Clone(e.targets)
+		seen    = make(map[uint64]bool, len(targets))
+	)
+
+	for _, t := range targets {
+		if t.path == "" {
+			seen[e.hostInode] = true
+		} else if inode := netnsInode(t.path); inode != 0 {
+			seen[inode] = true
+		}
+	}
+
+	add := func(discovered []target) {
+		for _, t := range discovered {
+			if !seen[t.inode] {
+				seen[t.inode] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+
+	if e.cfg.discoverNamed {
+		discovered, err := discoverNamedNetns(netnsDir)
+		if err != nil {
+			e.logger.Error("error discovering netns", slog.String("dir", netnsDir), slog.Any("error", err))
+		}
+
+		add(discovered)
+	}
+
+	if e.cfg.discoverProc {
+		discovered, err := discoverProcNetns(_procDir)
+		if err != nil {
+			e.logger.Error("error discovering netns of processes", slog.String("dir", _procDir), slog.Any("error", err))
+		}
+
+		add(discovered)
+	}
+
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.name
+	}
+
+	e.discovery.targets = targets
+	e.discovery.last = time.Now()
+
+	e.scrapeErrors.Retain(names)
+
+	return targets
+}
+
+// expireDiscovery makes the next scrape rediscover the netns.
+func (e *exporter) expireDiscovery() {
+	e.discovery.mu.Lock()
+	defer e.discovery.mu.Unlock()
+
+	e.discovery.targets = nil
+}
+
+// discoverNamedNetns returns the netns bind mounted in dir.  Files that are
+// not bind mounts of a netns, e.g. left over by a crashed `ip netns add`, are
+// ignored.
+func discoverNamedNetns(dir string) ([]target, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		var stat unix.Statfs_t
+		if err := unix.Statfs(path, &stat); err != nil {
+			continue
+		}
+
+		if stat.Type != unix.NSFS_MAGIC {
+			continue
+		}
+
+		inode := netnsInode(path)
+		if inode == 0 {
+			continue
+		}
+
+		targets = append(targets, target{name: entry.Name(), path: path, inode: inode})
+	}
+
+	return targets, nil
+}
+
+// discoverProcNetns returns the netns of the processes in procDir, one target
+// per netns.  The process with the lowest pid represents the netns.
+func discoverProcNetns(procDir string) ([]target, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make(map[uint64]int)
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			// not a process
+			continue
+		}
+
+		// Processes may exit or deny access at any time, so a netns we
+		// can't stat is skipped.
+		inode := netnsInode(filepath.Join(procDir, entry.Name(), "ns", "net"))
+		if inode == 0 {
+			continue
+		}
+
+		if other, ok := pids[inode]; !ok || pid < other {
+			pids[inode] = pid
+		}
+	}
+
+	targets := make([]target, 0, len(pids))
+
+	for inode, pid := range pids {
+		dir := filepath.Join(procDir, strconv.Itoa(pid))
+
+		targets = append(
+			targets,
+			target{
+				name:  "net:[" + strconv.FormatUint(inode, 10) + "]",
+				path:  filepath.Join(dir, "ns", "net"),
+				inode: inode,
+				labels: internal.Labels{
+					internal.Label{
+						Key:   "pid",
+						Value: strconv.Itoa(pid),
+					},
+					internal.Label{
+						Key:   "comm",
+						Value: readComm(dir),
+					},
+					internal.Label{
+						Key:   "cgroup",
+						Value: readCgroup(dir),
+					},
+				},
+			},
+		)
+	}
+
+	slices.SortFunc(targets, func(a, b target) int { return cmp.Compare(a.inode, b.inode) })
+
+	return targets, nil
+}
+
+// findProcNetns returns the netns file of a process in procDir that is in
+// the netns with the given inode, or the empty string if there is none.
+func findProcNetns(procDir string, inode uint64) string {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return ""
+	}
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			// not a process
+			continue
+		}
+
+		path := filepath.Join(procDir, entry.Name(), "ns", "net")
+		if netnsInode(path) == inode {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// netnsInode returns the inode of the netns file at path, which identifies
+// the netns, or 0 if it can't be determined.
+func netnsInode(path string) uint64 {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0
+	}
+
+	return stat.Ino
+}
+
+func readComm(procPidDir string) string {
+	comm, err := os.ReadFile(filepath.Join(procPidDir, "comm"))
+	if err != nil {
+		return ""
+	}
+
+	return string(bytes.TrimSpace(comm))
+}
+
+// readCgroup returns the cgroup v2 path of a process, or the path of its first
+// cgroup v1 hierarchy if there is no unified hierarchy.
+func readCgroup(procPidDir string) string {
+	content, err := os.ReadFile(filepath.Join(procPidDir, "cgroup"))
+	if err != nil {
+		return ""
+	}
+
+	var first string
+
+	for line := range strings.Lines(string(content)) {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+
+		if first == "" {
+			first = parts[2]
+		}
+	}
+
+	return first
+}
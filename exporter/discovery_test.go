@@ -0,0 +1,245 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestNetnsDiscovery(t *testing.T) {
+	name := fmt.Sprintf("conntrack-stats-exporter-test-%d", os.Getpid())
+
+	newNamedNetns(t, name)
+
+	var (
+		handler = exporter.Handler(
+			exporter.WithSource(fakeSource{stats: exporter.Stats{Count: 42}}),
+			exporter.WithNetnsDiscovery(0),
+		)
+		countRegex = regexp.MustCompile(`(?m)^conntrack_stats_count\{netns="` + name + `"} 42$`)
+		errorRegex = regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{netns="` + name + `",`)
+	)
+
+	body := scrape(t, handler)
+
+	if !countRegex.Match(body) || !errorRegex.Match(body) {
+		t.Errorf("expected to find metrics of discovered netns %q, but didn't", name)
+		t.Logf("response:\n%s", string(body))
+	}
+
+	if err := netns.DeleteNamed(name); err != nil {
+		t.Fatal(err)
+	}
+
+	body = scrape(t, handler)
+
+	if countRegex.Match(body) || errorRegex.Match(body) {
+		t.Errorf("expected metrics of deleted netns %q to be gone, but found some", name)
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+// newNamedNetns creates a named netns like `ip netns add` does.  It skips the
+// test if that is not permitted.
+func newNamedNetns(t *testing.T, name string) {
+	t.Helper()
+
+	errc := make(chan error)
+
+	go func() {
+		// Creating the netns switches the netns of the current thread, so
+		// we lock the thread and never unlock it.  The Go runtime terminates
+		// the thread when the goroutine exits (or wedges it, if it happens to
+		// be the main thread).
+		runtime.LockOSThread()
+
+		ns, err := netns.NewNamed(name)
+		if err == nil {
+			err = ns.Close()
+		}
+
+		errc <- err
+	}()
+
+	if err := <-errc; err != nil {
+		t.Skipf("Skipping test because creating a named netns failed: %v", err)
+	}
+
+	t.Cleanup(func() { _ = netns.DeleteNamed(name) })
+}
+
+func TestProcNetnsDiscovery(t *testing.T) {
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		t.Skip("Skipping test because unshare is not in $PATH")
+	}
+
+	cmd := exec.CommandContext(t.Context(), unshare, "--net", "sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	var (
+		own  = readlink(t, "/proc/self/ns/net")
+		dir  = fmt.Sprintf("/proc/%d", cmd.Process.Pid)
+		link string
+	)
+
+	// wait for unshare to exec sleep in the new netns
+	for range 100 {
+		comm, _ := os.ReadFile(dir + "/comm")
+		if link = readlink(t, dir+"/ns/net"); link != own && string(comm) == "sleep\n" {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if link == own || link == "" {
+		t.Skipf("Skipping test because unshare --net failed")
+	}
+
+	body := scrape(t, exporter.Handler(
+		exporter.WithSource(fakeSource{stats: exporter.Stats{Count: 42}}),
+		exporter.WithProcNetnsDiscovery(0),
+	))
+
+	want := fmt.Sprintf(`conntrack_stats_count{netns=%q,pid="%d",comm="sleep",cgroup="`, link, cmd.Process.Pid)
+	if !bytes.Contains(body, []byte(want)) {
+		t.Errorf("expected to find %s, but didn't", want)
+	}
+
+	if n := bytes.Count(body, []byte(fmt.Sprintf(`conntrack_stats_count{netns=%q,`, link))); n != 1 {
+		t.Errorf("expected the netns of the process to be gathered once, but was gathered %d times", n)
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+func readlink(t *testing.T, path string) string {
+	t.Helper()
+
+	link, err := os.Readlink(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	return link
+}
+
+// inodeSource reports the inode of the netns it is called in as count.
+type inodeSource struct{}
+
+func (inodeSource) Stats(context.Context, string) (exporter.Stats, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat("/proc/thread-self/ns/net", &stat); err != nil {
+		return exporter.Stats{}, err
+	}
+
+	return exporter.Stats{Count: stat.Ino}, nil
+}
+
+func TestProcNetnsDiscoveryPidReused(t *testing.T) {
+	var (
+		name  = fmt.Sprintf("conntrack-stats-exporter-test-%d", os.Getpid())
+		other = name + "-other"
+	)
+
+	// The other netns is certainly not the one discovered, unlike the netns
+	// of the test process: newNamedNetns may leave the main thread in the
+	// netns it created.
+	newNamedNetns(t, name)
+	newNamedNetns(t, other)
+
+	var (
+		procDir = t.TempDir()
+		netnsOf = func(pid, path string) {
+			t.Helper()
+
+			dir := filepath.Join(procDir, pid, "ns")
+			_ = os.RemoveAll(dir)
+
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Symlink(path, filepath.Join(dir, "net")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	)
+
+	exporter.SetProcDir(t, procDir)
+
+	var stat unix.Stat_t
+	if err := unix.Stat("/run/netns/"+name, &stat); err != nil {
+		t.Fatal(err)
+	}
+
+	netnsOf("100", "/run/netns/"+name)
+
+	handler := exporter.Handler(exporter.WithSource(inodeSource{}), exporter.WithProcNetnsDiscovery(time.Hour))
+
+	sample := func(pid string) string {
+		return fmt.Sprintf(`conntrack_stats_count{netns="net:[%d]",pid="%s",comm="",cgroup=""} %d`, stat.Ino, pid, stat.Ino)
+	}
+
+	if body := scrape(t, handler); !bytes.Contains(body, []byte(sample("100"))) {
+		t.Fatalf("expected to find %s in:\n%s", sample("100"), body)
+	}
+
+	// pid 100 exits and is reused by a process in another netns, while
+	// pid 200 remains in the netns discovered.
+	netnsOf("100", "/run/netns/"+other)
+	netnsOf("200", "/run/netns/"+name)
+
+	body := scrape(t, handler)
+
+	if !bytes.Contains(body, []byte(sample("100"))) {
+		t.Errorf("expected the metrics of the netns discovered via another process, %s, in:\n%s", sample("100"), body)
+	}
+
+	if bytes.Contains(body, []byte(`cause="netns_prepare"} 1`)) {
+		t.Errorf("expected no netns_prepare error, got:\n%s", body)
+	}
+
+	if body := scrape(t, handler); !bytes.Contains(body, []byte(sample("200"))) {
+		t.Errorf("expected the netns to be rediscovered via pid 200, %s, in:\n%s", sample("200"), body)
+	}
+}
@@ -0,0 +1,96 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"net/http"
+	"testing"
+)
+
+// SetProcfsStatPath makes the exporter read the procfs table from path for the
+// duration of the test.
+func SetProcfsStatPath(t testing.TB, path string) {
+	t.Helper()
+
+	orig := _procfsStatPath
+	_procfsStatPath = path
+
+	t.Cleanup(func() { _procfsStatPath = orig })
+}
+
+// SetPossibleCPUsPath makes the exporter read the list of the possible CPUs
+// from path for the duration of the test.
+func SetPossibleCPUsPath(t testing.TB, path string) {
+	t.Helper()
+
+	orig := _possibleCPUsPath
+	_possibleCPUsPath = path
+
+	t.Cleanup(func() { _possibleCPUsPath = orig })
+}
+
+// SetSysctlDir makes the exporter read the net.netfilter sysctls from dir for
+// the duration of the test.
+func SetSysctlDir(t testing.TB, dir string) {
+	t.Helper()
+
+	orig := _sysctlDir
+	_sysctlDir = dir
+
+	t.Cleanup(func() { _sysctlDir = orig })
+}
+
+// SetProcDir makes the exporter discover the netns of processes in dir for the
+// duration of the test.
+func SetProcDir(t testing.TB, dir string) {
+	t.Helper()
+
+	orig := _procDir
+	_procDir = dir
+
+	t.Cleanup(func() { _procDir = orig })
+}
+
+// ParseNetlinkMessages parses a netlink reply to the request with the sequence
+// number seq.
+func ParseNetlinkMessages(
+	buf []byte,
+	seq uint32,
+	dump bool,
+	fn func(resID uint16, attrs []byte) error,
+) (
+	done bool,
+	err error,
+) {
+	c := &ctnetlinkConn{seq: seq}
+
+	return c.parseMessages(buf, dump, fn)
+}
+
+// ParseNetlinkAttrs calls fn for each netlink attribute in buf.
+func ParseNetlinkAttrs(buf []byte, fn func(typ uint16, value []byte) error) error {
+	return parseAttrs(buf, fn)
+}
+
+// IgnoringEINTR calls fn until it is not interrupted by a signal.
+func IgnoringEINTR(fn func() error) error { return ignoringEINTR(fn) }
+
+// CoalescedScrapes returns the number of scrapes that joined the gathering of
+// another scrape so far.  The handler must be returned by Handler.
+func CoalescedScrapes(handler http.Handler) uint64 {
+	return handler.(*exporter).coalescing.coalesced.Load() //nolint:forcetypeassert
+}
@@ -17,13 +17,13 @@
 package exporter
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os/exec"
-	"regexp"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
@@ -31,36 +31,113 @@ import (
 
 type Option func(cfg *config)
 
+// Deprecated: use WithLogger.
 func WithErrorLogger(log func(string, ...any)) Option { return func(cfg *config) { cfg.logger = log } }
-func WithNetNs(netnsList []string) Option             { return func(cfg *config) { cfg.netnsList = netnsList } }
 func WithTimeout(timeout time.Duration) Option        { return func(cfg *config) { cfg.timeout = timeout } }
 func WithPrefix(prefix string) Option                 { return func(cfg *config) { cfg.prefix = prefix } }
 func WithFixMetricNames() Option                      { return func(cfg *config) { cfg.fixMetricNames = true } }
 
-func Handler(opts ...Option) http.Handler {
+// WithNetNs sets the netns to gather metrics for.  An entry is either the
+// name of a netns (see ip-netns(8)) or has the form [label=]kind:netns with
+// one of the following kinds:
+//
+//   - name:foo is the netns named foo, the same as just foo.
+//   - path:/run/docker/netns/1a2b3c is the netns of a netns file.
+//   - pid:1234 is the netns of the process with pid 1234.
+//
+// The label is the value of the netns label of the samples and defaults to
+// the name or to the entry without label, respectively.  The empty string is
+// the netns of the exporter itself.  Invalid entries are reported as scrape
+// errors, use CheckNetNs to validate them upfront.
+func WithNetNs(netnsList []string) Option { return func(cfg *config) { cfg.netnsList = netnsList } }
+
+// WithProcfs is a shorthand for WithSource(ProcfsSource()).
+func WithProcfs() Option { return WithSource(ProcfsSource()) }
+
+// WithNetlink is a shorthand for WithSource(NetlinkSource()).
+func WithNetlink() Option { return WithSource(NetlinkSource()) }
+
+func Handler(opts ...Option) http.Handler { return newExporter(opts...) }
+
+func newExporter(opts ...Option) *exporter {
+	cfg := newConfig(opts...)
+	targets, names := parseTargets(cfg.netnsList)
+
+	e := newExporterWith(cfg, targets, internal.NewScrapeErrors(names, sourceOps(cfg.source), cfg.errorHistory))
+	e.start()
+
+	return e
+}
+
+// newConfig returns the default config modified by opts.
+func newConfig(opts ...Option) config {
 	// default config values
 	cfg := config{
-		netnsList: []string{""},
-		timeout:   3 * time.Second,
-		prefix:    "conntrack_stats",
-		logger:    nil,
+		netnsList:    []string{""},
+		timeout:      3 * time.Second,
+		prefix:       "conntrack_stats",
+		logger:       nil,
+		source:       ToolSource(),
+		parallelism:  4,
+		errorHistory: 10,
 	}
 
 	for _, opt := range opts {
 		opt(&cfg)
 	}
 
-	scrapeErrors := internal.NewScrapeErrors(cfg.netnsList)
+	return cfg
+}
+
+// parseTargets parses the entries of WithNetNs and returns the targets along
+// with their names.
+func parseTargets(netnsList []string) ([]target, []string) {
+	targets := make([]target, 0, len(netnsList))
+	names := make([]string, 0, len(netnsList))
+
+	for _, spec := range netnsList {
+		t := parseTarget(spec)
+		targets = append(targets, t)
+		names = append(names, t.name)
+	}
+
+	return targets, names
+}
+
+// newExporterWith returns an exporter that is not started yet.
+func newExporterWith(cfg config, targets []target, scrapeErrors *internal.ScrapeErrors) *exporter {
+	logger := newLogger(cfg)
 
-	logger := func(string, ...any) {}
-	if cfg.logger != nil {
-		logger = cfg.logger
+	if src, ok := cfg.source.(interface{ withLogger(*slog.Logger) Source }); ok {
+		cfg.source = src.withLogger(logger)
 	}
 
 	return &exporter{
 		cfg:          cfg,
 		scrapeErrors: scrapeErrors,
-		log:          logger,
+		logger:       logger,
+		targets:      targets,
+		hostInode:    netnsInode(hostNetnsPath),
+		created:      time.Now(),
+		constLabels:  constLabels(cfg.constLabels, logger),
+	}
+}
+
+// start looks up the version of the conntrack tool and starts polling, if
+// configured.
+func (e *exporter) start() {
+	if e.usesTool() {
+		ctx, cancel := context.WithTimeout(context.Background(), e.cfg.timeout)
+		_ = e.toolVersion(ctx)
+
+		cancel()
+	}
+
+	if e.cfg.pollInterval > 0 {
+		ctx, cancel := context.WithCancel(e.cfg.pollCtx)
+		e.stopPolling = cancel
+
+		go e.poll(ctx, e.cfg.pollInterval)
 	}
 }
 
@@ -69,13 +146,54 @@ type config struct {
 	timeout        time.Duration
 	prefix         string
 	logger         func(string, ...any)
+	slogger        *slog.Logger
 	fixMetricNames bool
+	source         Source
+
+	parallelism  int
+	netnsTimeout time.Duration
+
+	discoverNamed     bool
+	discoverProc      bool
+	discoveryInterval time.Duration
+
+	pollCtx      context.Context //nolint:containedctx
+	pollInterval time.Duration
+
+	coalesce bool
+
+	openMetrics bool
+
+	aggregation  Aggregation
+	metricFilter internal.Filter
+
+	constLabels map[string]string
+
+	errorHistory int
 }
 
 type exporter struct {
 	cfg          config
 	scrapeErrors *internal.ScrapeErrors
-	log          func(string, ...any)
+	logger       *slog.Logger
+
+	// targets are the netns set by WithNetNs.
+	targets []target
+
+	discovery discovery
+	hostInode uint64
+
+	// created is when the counters of the exporter itself started counting.
+	created time.Time
+
+	// constLabels are the labels of WithConstLabels.
+	constLabels internal.Labels
+
+	toolInfo toolInfo
+
+	snapshot    atomic.Pointer[snapshot]
+	stopPolling context.CancelFunc
+	coalescing  coalescing
 }
 
 func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -84,191 +202,201 @@ func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), e.cfg.timeout)
-	defer cancel()
+	metrics, ok := e.snapshotMetrics()
+	if !ok && e.cfg.coalesce {
+		metrics, ok = e.collectCoalesced(r.Context())
+		if !ok {
+			// the client is gone
+			return
+		}
+	}
 
-	metrics := internal.NewMetrics(e.cfg.fixMetricNames)
+	if !ok {
+		metrics = e.collect(r.Context())
+	}
 
-	for _, netns := range e.cfg.netnsList {
-		err := e.gatherMetricsForNetNs(ctx, netns, metrics)
-		if err != nil {
-			e.log("error gathering metrics for netns %q: %v\n", netns, err)
-		}
+	if collect := r.URL.Query()["collect[]"]; len(collect) > 0 {
+		metrics = metrics.Select(collect)
 	}
 
-	metrics.GatherScrapeErrors(e.cfg.prefix, e.scrapeErrors)
+	format := negotiateFormat(r.Header.Get("Accept"), e.cfg.openMetrics)
+
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+	w.Header().Set("Content-Type", format.contentType())
+
+	if enc := negotiateEncoding(r.Header.Get("Accept-Encoding")); enc != nil {
+		cw := &compressWriter{ResponseWriter: w, encoding: enc}
+
+		defer func() {
+			if err := cw.Close(); err != nil {
+				e.logger.ErrorContext(r.Context(), "error compressing metrics", slog.Any("error", err))
+			}
+		}()
+
+		w = cw
+	}
 
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
-	_, err := metrics.WriteTo(w)
+	_, err := format.write(w, metrics)
 	if err != nil {
-		e.log("error writing metrics to response writer: %v\n", err)
+		e.logger.ErrorContext(r.Context(), "error writing metrics to response writer", slog.Any("error", err))
 		return
 	}
 }
 
-func (e *exporter) gatherMetricsForNetNs(ctx context.Context, netns string, metrics internal.Metrics) error {
-	statsOutput, countOutput, err := e.execConntrackTool(ctx, netns)
-	if err != nil {
-		return err
-	}
-
-	matches := _regex.FindAllSubmatch(statsOutput, -1)
+// collect gathers the metrics of all netns.
+func (e *exporter) collect(ctx context.Context) internal.Metrics {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.timeout)
+	defer cancel()
 
-	if len(matches) == 0 {
-		return e.scrapeErrors.Count(netns, internal.OpToolOutputNoMatch, nil)
-	}
+	metrics := internal.NewMetrics(e.cfg.fixMetricNames, e.cfg.metricFilter, e.constLabels)
 
-	for _, match := range matches {
-		var cpu []byte
+	e.gather(ctx, e.netnsTargets(), metrics)
 
-		for i, metricShortName := range _regex.SubexpNames() {
-			value := match[i]
+	metrics.GetOrInit(e.cfg.prefix, "gauge", "build_info").AddSample(buildInfo(), "1")
 
-			if len(value) == 0 {
-				// skip empty sub-matches
-				continue
-			}
-
-			switch metricShortName {
-			case "":
-				// skip full match
-				continue
-			case "cpu":
-				cpu = value
-			default:
-				if len(cpu) == 0 {
-					return e.scrapeErrors.Count(
-						netns,
-						internal.OpToolOutputNoMatch,
-						fmt.Errorf("no cpu value for: %q", metricShortName),
-					)
-				}
-
-				metrics.GetOrInit(e.cfg.prefix, "counter", metricShortName).AddSample(
-					internal.Labels{
-						internal.Label{
-							Key:   "cpu",
-							Value: string(cpu),
-						},
-						internal.Label{
-							Key:   "netns",
-							Value: netns,
-						},
-					},
-					string(value),
-				)
-			}
+	// The tool is the same in all netns.
+	if e.usesTool() {
+		if version := e.toolVersion(ctx); version != "" {
+			metrics.GetOrInit(e.cfg.prefix, "gauge", "tool_info").AddSample(
+				internal.Labels{internal.Label{Key: "version", Value: version}},
+				"1",
+			)
 		}
 	}
 
-	metrics.GetOrInit(e.cfg.prefix, "gauge", "count").AddSample(
-		internal.Labels{
-			internal.Label{
-				Key:   "netns",
-				Value: netns,
-			},
-		},
-		countOutput,
-	)
+	metrics.GatherScrapeErrors(e.cfg.prefix, e.scrapeErrors)
 
-	return nil
+	// Sorting once here is cheaper than sorting on every merge, which is
+	// quadratic in the number of netns.
+	metrics.Sort()
+
+	return metrics
 }
 
-func (e *exporter) execConntrackTool(
-	ctx context.Context,
-	netns string,
-) (
-	statsOutput []byte,
-	countOutput string,
-	err error,
-) {
-	for _, fn := range []func() error{
-		func() error {
-			var err error
-
-			statsOutput, err = getConntrackStats(ctx)
-
-			return err
-		},
-		func() error {
-			var err error
-
-			countOutput, err = getConntrackCounter(ctx)
-
-			return err
-		},
-	} {
-		var errExec error
-
-		errNs := e.execInNetns(netns, func() { errExec = fn() })
-		if errNs != nil {
-			return nil, "", fmt.Errorf("error executing in netns %q: %w", netns, errNs)
+func (e *exporter) gatherMetricsForNetNs(ctx context.Context, t target, metrics internal.Metrics) (err error) {
+	netns := t.name
+
+	start := time.Now()
+
+	defer func() {
+		up := "0"
+		if err == nil {
+			up = "1"
+
+			e.scrapeErrors.Success(netns, time.Now())
 		}
 
-		ctxErr := ctx.Err()
+		metrics.GetOrInit(e.cfg.prefix, "gauge", "up").AddSample(t.sampleLabels(), up)
+		metrics.GetOrInit(e.cfg.prefix, "gauge", "scrape_duration_seconds").AddSample(
+			t.sampleLabels(),
+			strconv.FormatFloat(time.Since(start).Seconds(), 'f', -1, 64),
+		)
 
-		if errors.Is(ctxErr, context.DeadlineExceeded) {
-			return nil, "", e.scrapeErrors.Count(
-				netns,
-				internal.OpTimeout,
-				errExec,
+		if last, ok := e.scrapeErrors.LastSuccess(netns); ok {
+			metrics.GetOrInit(e.cfg.prefix, "gauge", "last_success_timestamp_seconds").AddSample(
+				t.sampleLabels(),
+				strconv.FormatFloat(float64(last.UnixMilli())/1e3, 'f', 3, 64),
 			)
 		}
+	}()
 
-		if errors.Is(ctxErr, context.Canceled) {
-			return nil, "", e.scrapeErrors.Count(
-				netns,
-				internal.OpClientGone,
-				errExec,
-			)
+	var (
+		stats     Stats
+		sysctls   map[string]uint64
+		errStats  error
+		errSysctl error
+	)
+
+	errNs := e.execInNetns(t, func() {
+		stats, errStats = e.cfg.source.Stats(ctx, netns)
+		if errStats == nil {
+			sysctls, errSysctl = readSysctls()
 		}
+	})
+	if errNs != nil {
+		return fmt.Errorf("error executing in netns %q: %w", netns, errNs)
+	}
 
-		if errExec != nil {
-			return nil, "", e.scrapeErrors.Count(
-				netns,
-				internal.OpExecTool,
-				fmt.Errorf("failed to exec conntrack tool: %w", errExec),
-			)
+	ctxErr := ctx.Err()
+
+	if errors.Is(ctxErr, context.DeadlineExceeded) {
+		return e.scrapeErrors.Count(netns, internal.OpTimeout, errStats)
+	}
+
+	if errors.Is(ctxErr, context.Canceled) {
+		return e.scrapeErrors.Count(netns, internal.OpClientGone, errStats)
+	}
+
+	if errStats != nil {
+		op := internal.OpSource
+
+		var errOp *opError
+		if errors.As(errStats, &errOp) {
+			op, errStats = errOp.op, errOp.err
 		}
+
+		return e.scrapeErrors.Count(netns, op, errStats)
 	}
 
-	return statsOutput, countOutput, nil
-}
+	sums := make(map[string]uint64)
 
-func getConntrackCounter(ctx context.Context) (string, error) {
-	cmd := exec.CommandContext(ctx, "conntrack", "--count")
+	for _, cpu := range stats.CPUs {
+		for metricShortName, value := range cpu.Counters {
+			sums[metricShortName] += value
 
-	out, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("error running the conntrack command with the --count flag: %w", err)
+			if e.cfg.aggregation == AggregateSum {
+				continue
+			}
+
+			metrics.GetOrInit(e.cfg.prefix, "counter", metricShortName).AddSample(
+				t.sampleLabels(
+					internal.Label{
+						Key:   "cpu",
+						Value: strconv.Itoa(cpu.CPU),
+					},
+				),
+				strconv.FormatUint(value, 10),
+			)
+		}
 	}
 
-	return string(bytes.TrimSpace(out)), nil
-}
+	if e.cfg.aggregation != AggregatePerCPU {
+		for metricShortName, value := range sums {
+			metrics.GetOrInit(e.cfg.prefix, "counter", metricShortName+internal.SumSuffix).AddSample(
+				t.sampleLabels(),
+				strconv.FormatUint(value, 10),
+			)
+		}
+	}
 
-func getConntrackStats(ctx context.Context) ([]byte, error) {
-	cmd := exec.CommandContext(ctx, "conntrack", "--stats")
+	metrics.GetOrInit(e.cfg.prefix, "gauge", "count").AddSample(
+		t.sampleLabels(),
+		strconv.FormatUint(stats.Count, 10),
+	)
 
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("error running the conntrack command with the --stats flag: %w", err)
+	for metricShortName, value := range sysctls {
+		metrics.GetOrInit(e.cfg.prefix, "gauge", metricShortName).AddSample(
+			t.sampleLabels(),
+			strconv.FormatUint(value, 10),
+		)
 	}
 
-	return output, nil
-}
+	if limit := sysctls["max"]; limit > 0 {
+		metrics.GetOrInit(e.cfg.prefix, "gauge", "fill_ratio").AddSample(
+			t.sampleLabels(),
+			strconv.FormatFloat(float64(stats.Count)/float64(limit), 'g', -1, 64),
+		)
+	}
 
-var _regex = regexp.MustCompile(`` +
-	`(?m)` +
-	`cpu=(?P<cpu>\d+)\s+` +
-	`found=(?P<found>\d+)\s+` +
-	`invalid=(?P<invalid>\d+)\s+` +
-	`(?:ignore=(?P<ignore>\d+)\s+)?` +
-	`insert=(?P<insert>\d+)\s+` +
-	`insert_failed=(?P<insert_failed>\d+)\s+` +
-	`drop=(?P<drop>\d+)\s+` +
-	`early_drop=(?P<early_drop>\d+)\s+` +
-	`error=(?P<error>\d+)\s+` +
-	`search_restart=(?P<search_restart>\d+)`,
-)
+	if errSysctl != nil {
+		return e.scrapeErrors.Count(
+			netns,
+			internal.OpSysctlRead,
+			fmt.Errorf("failed to read conntrack sysctls: %w", errSysctl),
+		)
+	}
+
+	return nil
+}
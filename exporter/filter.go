@@ -0,0 +1,52 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import "regexp"
+
+// WithMetricFilter sets which metrics to expose by their short names, e.g.
+// drop for conntrack_stats_drop.  A metric is exposed if include, if not nil,
+// matches its whole short name and exclude, if not nil, doesn't.  The sum of
+// a counter over all CPUs (see WithAggregation) is filtered as the counter.
+//
+// Scrapes can select metrics further by their short names with the query
+// parameter collect[], which may be repeated.
+func WithMetricFilter(include, exclude *regexp.Regexp) Option {
+	return func(cfg *config) {
+		if include == nil && exclude == nil {
+			cfg.metricFilter = nil
+
+			return
+		}
+
+		include, exclude = anchor(include), anchor(exclude)
+
+		cfg.metricFilter = func(metricName string) bool {
+			return (include == nil || include.MatchString(metricName)) &&
+				(exclude == nil || !exclude.MatchString(metricName))
+		}
+	}
+}
+
+// anchor returns regex matching whole strings only.
+func anchor(regex *regexp.Regexp) *regexp.Regexp {
+	if regex == nil {
+		return nil
+	}
+
+	return regexp.MustCompile(`^(?:` + regex.String() + `)$`)
+}
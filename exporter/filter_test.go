@@ -0,0 +1,110 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestMetricFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		include, exclude *regexp.Regexp
+		collect          string
+		want             []string
+	}{
+		{
+			name: "no filter",
+			want: []string{
+				"build_info", "count", "drop", "drop_all_cpus", "insert_failed", "insert_failed_all_cpus",
+				"last_success_timestamp_seconds", "scrape_duration_seconds", "scrape_error", "up",
+			},
+		},
+		{
+			name:    "include",
+			include: regexp.MustCompile(`drop|count`),
+			want:    []string{"count", "drop", "drop_all_cpus"},
+		},
+		{
+			name:    "include matches whole names",
+			include: regexp.MustCompile(`insert`),
+			want:    []string{},
+		},
+		{
+			name:    "exclude",
+			exclude: regexp.MustCompile(`insert_.*|scrape_error`),
+			want: []string{
+				"build_info", "count", "drop", "drop_all_cpus",
+				"last_success_timestamp_seconds", "scrape_duration_seconds", "up",
+			},
+		},
+		{
+			name:    "include and exclude",
+			include: regexp.MustCompile(`.*_.*`),
+			exclude: regexp.MustCompile(`scrape_error`),
+			want: []string{
+				"build_info", "insert_failed", "insert_failed_all_cpus",
+				"last_success_timestamp_seconds", "scrape_duration_seconds",
+			},
+		},
+		{
+			name:    "collect",
+			collect: "?collect[]=drop&collect[]=scrape_error",
+			want:    []string{"drop", "drop_all_cpus", "scrape_error"},
+		},
+		{
+			name:    "collect and exclude",
+			exclude: regexp.MustCompile(`drop`),
+			collect: "?collect[]=drop&collect[]=count",
+			want:    []string{"count"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// no sysctl gauges
+			exporter.SetSysctlDir(t, t.TempDir())
+
+			handler := exporter.Handler(
+				exporter.WithSource(fakeSource{stats: testStats}),
+				exporter.WithAggregation(exporter.AggregateBoth),
+				exporter.WithMetricFilter(tc.include, tc.exclude),
+			)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(
+				recorder,
+				httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/"+tc.collect, http.NoBody),
+			)
+
+			body := recorder.Body.Bytes()
+
+			got := []string{}
+			for _, match := range regexp.MustCompile(`(?m)^# TYPE conntrack_stats_(\w+) `).FindAllSubmatch(body, -1) {
+				got = append(got, string(match[1]))
+			}
+
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expected metrics %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// WithOpenMetrics makes the exporter serve the OpenMetrics format to scrapes
+// preferring it, e.g. to Prometheus by default.  OpenMetrics requires the names
+// of counters to end with _total, so unless WithFixMetricNames is used as well,
+// the series of the counters are renamed.  Without it, the exporter serves the
+// text format instead.
+func WithOpenMetrics() Option { return func(cfg *config) { cfg.openMetrics = true } }
+
+// format is an exposition format.
+type format int
+
+const (
+	// formatText is the Prometheus text format 0.0.4.
+	formatText format = iota
+
+	// formatOpenMetrics is the OpenMetrics 1.0 text format.
+	formatOpenMetrics
+
+	// formatProtobuf is the length-delimited protobuf format.
+	formatProtobuf
+)
+
+func (f format) contentType() string {
+	switch f {
+	case formatOpenMetrics:
+		return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	case formatProtobuf:
+		return "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	default:
+		return "text/plain; version=0.0.4; charset=utf-8"
+	}
+}
+
+func (f format) write(w io.Writer, metrics internal.Metrics) (int64, error) {
+	switch f {
+	case formatOpenMetrics:
+		return metrics.WriteOpenMetricsTo(w)
+	case formatProtobuf:
+		return metrics.WriteProtobufTo(w)
+	default:
+		return metrics.WriteTo(w)
+	}
+}
+
+// negotiateFormat returns the format of the media range with the highest
+// quality in the Accept header that names a supported format, and the text
+// format if there is none.  On equal quality the earlier media range wins.
+// OpenMetrics is supported only if openMetrics is set.
+func negotiateFormat(accept string, openMetrics bool) format {
+	var (
+		best  = formatText
+		bestQ = 0.0
+	)
+
+	for mediaRange := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		if q <= bestQ {
+			continue
+		}
+
+		var f format
+
+		switch version := params["version"]; {
+		case mediaType == "application/openmetrics-text" && (version == "" || version == "1.0.0") && openMetrics:
+			f = formatOpenMetrics
+		case mediaType == "text/plain" && (version == "" || version == "0.0.4"):
+			f = formatText
+		case mediaType == "application/vnd.google.protobuf" &&
+			params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited":
+			f = formatProtobuf
+		default:
+			continue
+		}
+
+		best, bestQ = f, q
+	}
+
+	return best
+}
@@ -0,0 +1,315 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func scrapeAccept(t *testing.T, handler http.Handler, accept string) (string, []byte) {
+	t.Helper()
+
+	request := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", recorder.Code)
+	}
+
+	return recorder.Header().Get("Content-Type"), recorder.Body.Bytes()
+}
+
+func TestFormatNegotiation(t *testing.T) {
+	const (
+		text        = "text/plain; version=0.0.4; charset=utf-8"
+		openMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+		protobuf    = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	)
+
+	handler := exporter.Handler(exporter.WithSource(fakeSource{}), exporter.WithOpenMetrics())
+
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", text},
+		{"*/*", text},
+		{"text/plain", text},
+		{"application/json", text},
+		{"application/openmetrics-text", openMetrics},
+		{"application/openmetrics-text; version=1.0.0", openMetrics},
+		{"application/openmetrics-text; version=0.0.1", text},
+		{
+			"application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4," +
+				"text/plain;version=0.0.4;q=0.3,*/*;q=0.2",
+			openMetrics,
+		},
+		{"text/plain;q=0.9,application/openmetrics-text;q=0.5", text},
+		{"application/openmetrics-text;q=0,text/plain;q=0.1", text},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited", protobuf},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=text", text},
+		{
+			"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7," +
+				"text/plain;version=0.0.4;q=0.3",
+			protobuf,
+		},
+	} {
+		if got, _ := scrapeAccept(t, handler, tc.accept); got != tc.want {
+			t.Errorf("Accept: %q: expected Content-Type %q, got %q", tc.accept, tc.want, got)
+		}
+	}
+}
+
+func TestOpenMetricsOptIn(t *testing.T) {
+	const (
+		text     = "text/plain; version=0.0.4; charset=utf-8"
+		protobuf = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+
+		// the default of Prometheus
+		accept = "application/openmetrics-text;version=1.0.0;escaping=allow-utf-8;q=0.5," +
+			"application/openmetrics-text;version=0.0.1;q=0.4,text/plain;version=1.0.0;escaping=allow-utf-8;q=0.3," +
+			"text/plain;version=0.0.4;q=0.2,*/*;q=0.1"
+	)
+
+	handler := exporter.Handler(exporter.WithSource(fakeSource{stats: testStats}))
+
+	contentType, body := scrapeAccept(t, handler, accept)
+	if contentType != text {
+		t.Errorf("expected Content-Type %q, got %q", text, contentType)
+	}
+
+	if want := []byte(`conntrack_stats_drop{cpu="0",netns=""} 4`); !bytes.Contains(body, want) {
+		t.Errorf("expected the counters to keep their names, e.g. %s, got:\n%s", want, body)
+	}
+
+	if got, _ := scrapeAccept(t, handler, "application/vnd.google.protobuf;"+
+		"proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,"+accept); got != protobuf {
+		t.Errorf("expected Content-Type %q, got %q", protobuf, got)
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	_, body := scrapeAccept(t, exporter.Handler(exporter.WithSource(fakeSource{stats: testStats})), "")
+
+	checkText(t, body)
+
+	for _, regex := range []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^# TYPE conntrack_stats_drop counter$`),
+		regexp.MustCompile(`(?m)^conntrack_stats_drop\{cpu="0",netns=""} 4$`),
+		regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{netns="",cause="source"} 0$`),
+	} {
+		if !regex.Match(body) {
+			t.Errorf("expected response to match %s, but didn't", regex)
+		}
+	}
+
+	for _, regex := range []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^# EOF$`),
+		regexp.MustCompile(`(?m)^# UNIT `),
+		regexp.MustCompile(`(?m)_created[ {]`),
+	} {
+		if regex.Match(body) {
+			t.Errorf("expected response not to match %s, but did", regex)
+		}
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+func TestOpenMetricsFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []exporter.Option
+		want []string
+	}{
+		{
+			name: "default names",
+			want: []string{
+				`# TYPE conntrack_stats_drop counter`,
+				`conntrack_stats_drop_total{cpu="0",netns=""} 4`,
+				`# TYPE conntrack_stats_count gauge`,
+				`conntrack_stats_count{netns=""} 42`,
+				`# TYPE conntrack_stats_scrape_error counter`,
+				`conntrack_stats_scrape_error_total{netns="",cause="source"} 0`,
+				`# TYPE conntrack_stats_snapshot_age_seconds gauge`,
+				`# UNIT conntrack_stats_snapshot_age_seconds seconds`,
+			},
+		},
+		{
+			name: "fixed names",
+			opts: []exporter.Option{exporter.WithFixMetricNames()},
+			want: []string{
+				`# TYPE conntrack_stats_drop counter`,
+				`conntrack_stats_drop_total{cpu="0",netns=""} 4`,
+				`# TYPE conntrack_stats_count_current gauge`,
+				`# TYPE conntrack_stats_build_info gauge`,
+				`# TYPE conntrack_stats_up gauge`,
+				`# TYPE conntrack_stats_scrape_duration_seconds gauge`,
+				`# UNIT conntrack_stats_scrape_duration_seconds seconds`,
+				`# TYPE conntrack_stats_snapshot_age_seconds gauge`,
+				`# UNIT conntrack_stats_snapshot_age_seconds seconds`,
+				`# TYPE conntrack_stats_scrape_error counter`,
+				`conntrack_stats_scrape_error_total{netns="",cause="source"} 0`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := exporter.Handler(
+				append(
+					[]exporter.Option{
+						exporter.WithSource(fakeSource{stats: testStats}),
+						exporter.WithPolling(t.Context(), time.Hour),
+						exporter.WithOpenMetrics(),
+					},
+					tc.opts...,
+				)...,
+			)
+
+			// wait for the snapshot
+			var body []byte
+			for !bytes.Contains(body, []byte("snapshot_age_seconds")) {
+				_, body = scrapeAccept(t, handler, "application/openmetrics-text")
+			}
+
+			checkOpenMetrics(t, body)
+
+			for _, want := range tc.want {
+				if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+					t.Errorf("expected to find %s, but didn't", want)
+				}
+			}
+
+			created := regexp.MustCompile(
+				`(?m)^conntrack_stats_scrape_error_created\{netns="",cause="source"} \d+\.\d{3}$`,
+			)
+			if !created.Match(body) {
+				t.Errorf("expected response to match %s, but didn't", created)
+			}
+
+			if t.Failed() {
+				t.Logf("response:\n%s", string(body))
+			}
+		})
+	}
+}
+
+var testStats = exporter.Stats{
+	CPUs: []exporter.CPUStats{
+		{CPU: 0, Counters: map[string]uint64{"insert_failed": 17, "drop": 4}},
+		{CPU: 1, Counters: map[string]uint64{"insert_failed": 23, "drop": 0}},
+	},
+	Count: 42,
+}
+
+var (
+	_metadataLine = regexp.MustCompile(`^# (HELP|TYPE|UNIT) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	_sampleLine   = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^}]*})? (\S+)$`)
+)
+
+// checkText checks that every line of body is metadata or a sample of the
+// metric announced last, and that no metric is announced twice.
+func checkText(t *testing.T, body []byte) {
+	t.Helper()
+
+	checkFamilies(t, body, func(family, sample, _ string) bool { return sample == family })
+}
+
+// checkOpenMetrics checks the OpenMetrics output as checkText does, and that
+// it ends with # EOF and the samples of counters are suffixed as they must.
+func checkOpenMetrics(t *testing.T, body []byte) {
+	t.Helper()
+
+	eof := []byte("# EOF\n")
+	if !bytes.HasSuffix(body, eof) {
+		t.Errorf("expected OpenMetrics output to end with # EOF")
+	}
+
+	checkFamilies(t, bytes.TrimSuffix(body, eof), func(family, sample, typ string) bool {
+		if typ == "counter" {
+			return sample == family+"_total" || sample == family+"_created"
+		}
+
+		return sample == family
+	})
+}
+
+func checkFamilies(t *testing.T, body []byte, sampleOf func(family, sample, typ string) bool) {
+	t.Helper()
+
+	var (
+		family string
+		types  = make(map[string]string)
+		seen   = make(map[string]bool)
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := _metadataLine.FindStringSubmatch(line); match != nil {
+			if match[2] != family {
+				family = match[2]
+
+				if seen[family] {
+					t.Errorf("metric %s is not contiguous", family)
+				}
+
+				seen[family] = true
+			}
+
+			if match[1] == "TYPE" {
+				types[family] = match[3]
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			t.Errorf("unexpected comment %q", line)
+
+			continue
+		}
+
+		match := _sampleLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("invalid sample %q", line)
+
+			continue
+		}
+
+		if !sampleOf(family, match[1], types[family]) {
+			t.Errorf("sample %q does not belong to metric %s of type %s", line, family, types[family])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// WithParallelism sets the maximum number of netns gathered concurrently.
+// Values less than 1 are treated as 1.
+func WithParallelism(n int) Option { return func(cfg *config) { cfg.parallelism = max(n, 1) } }
+
+// WithNetnsTimeout sets the timeout for gathering the metrics of a single
+// netns, so a slow netns does not starve the others.  The timeout set by
+// WithTimeout still applies to the scrape as a whole.  Zero disables the per
+// netns timeout.
+func WithNetnsTimeout(timeout time.Duration) Option {
+	return func(cfg *config) { cfg.netnsTimeout = timeout }
+}
+
+// gather gathers the metrics of all targets into metrics using a bounded pool
+// of workers.  The metrics of a netns are merged as soon as the netns is
+// done, so metrics of netns that failed do not affect the others.
+func (e *exporter) gather(ctx context.Context, targets []target, metrics internal.Metrics) {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		jobs = make(chan target)
+	)
+
+	merge := func(m internal.Metrics) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		metrics.Merge(m)
+	}
+
+	var worker func()
+
+	worker = func() {
+		// Every worker owns a locked OS thread, which execInNetns moves
+		// into the target netns and back.
+		runtime.LockOSThread()
+
+		for t := range jobs {
+			m := internal.NewMetrics(e.cfg.fixMetricNames, e.cfg.metricFilter, e.constLabels)
+
+			err := e.gatherNetNs(ctx, t, m)
+
+			merge(m)
+
+			if err == nil {
+				continue
+			}
+
+			e.logError(ctx, "error gathering metrics", err, slog.String("netns", t.name))
+
+			var errNs internal.Err
+			if errors.As(err, &errNs) && errNs.Op() == internal.OpNetnsRestore {
+				// The thread is stuck in the target netns.  Leave it
+				// locked, so the Go runtime terminates it when this
+				// goroutine exits, and hand over to a fresh worker.
+				wg.Go(worker)
+
+				return
+			}
+		}
+
+		runtime.UnlockOSThread()
+	}
+
+	for range min(e.cfg.parallelism, len(targets)) {
+		wg.Go(worker)
+	}
+
+	for _, t := range targets {
+		jobs <- t
+	}
+
+	close(jobs)
+	wg.Wait()
+}
+
+// gatherNetNs gathers the metrics of a single netns with the per netns
+// timeout.
+func (e *exporter) gatherNetNs(ctx context.Context, t target, metrics internal.Metrics) error {
+	if e.cfg.netnsTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, e.cfg.netnsTimeout)
+		defer cancel()
+	}
+
+	return e.gatherMetricsForNetNs(ctx, t, metrics)
+}
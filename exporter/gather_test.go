@@ -0,0 +1,218 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+// slowSource blocks for the netns named "slow" until the context is done and
+// takes a little while for the others, recording how many netns it serves
+// concurrently.
+type slowSource struct {
+	current, max atomic.Int32
+}
+
+func (s *slowSource) Stats(ctx context.Context, netns string) (exporter.Stats, error) {
+	n := s.current.Add(1)
+	defer s.current.Add(-1)
+
+	for {
+		m := s.max.Load()
+		if n <= m || s.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+
+	if netns == "slow" {
+		<-ctx.Done()
+
+		return exporter.Stats{}, ctx.Err()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	return exporter.Stats{Count: 42}, nil
+}
+
+func TestParallelism(t *testing.T) {
+	var (
+		self        = fmt.Sprintf("pid:%d", os.Getpid())
+		src         = new(slowSource)
+		errorLogBuf = new(bytes.Buffer)
+		start       = time.Now()
+	)
+
+	body := scrape(t, exporter.Handler(
+		exporter.WithSource(src),
+		exporter.WithNetNs([]string{"", "a=" + self, "b=" + self, "c=" + self, "slow=" + self}),
+		exporter.WithParallelism(2),
+		exporter.WithTimeout(5*time.Second),
+		exporter.WithNetnsTimeout(200*time.Millisecond),
+		exporter.WithErrorLogger(logger(errorLogBuf)),
+	))
+
+	elapsed := time.Since(start)
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{netns="a",cause="netns_enter"} 1$`).Match(body) {
+		t.Skipf("Skipping test because entering a netns is not permitted: %s", errorLogBuf.String())
+	}
+
+	for _, want := range []string{
+		`conntrack_stats_count{netns=""} 42`,
+		`conntrack_stats_count{netns="a"} 42`,
+		`conntrack_stats_count{netns="b"} 42`,
+		`conntrack_stats_count{netns="c"} 42`,
+		`conntrack_stats_scrape_error{netns="slow",cause="timeout"} 1`,
+	} {
+		if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+			t.Errorf("expected to find %s, but didn't", want)
+		}
+	}
+
+	if got := src.max.Load(); got != 2 {
+		t.Errorf("expected 2 netns to be gathered concurrently, got %d", got)
+	}
+
+	if elapsed > time.Second {
+		t.Errorf("expected the slow netns to time out on its own, but the scrape took %v", elapsed)
+	}
+
+	if t.Failed() {
+		t.Logf("error log:\n%s", errorLogBuf.String())
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+// flakySource fails every other call.
+type flakySource struct{ calls atomic.Int64 }
+
+func (f *flakySource) Stats(context.Context, string) (exporter.Stats, error) {
+	if f.calls.Add(1)%2 == 0 {
+		return exporter.Stats{}, errors.New("kaputt")
+	}
+
+	return exporter.Stats{Count: 42}, nil
+}
+
+func TestNetnsUp(t *testing.T) {
+	handler := exporter.Handler(
+		exporter.WithSource(new(flakySource)),
+		exporter.WithNetNs([]string{"", "invalid=pid:0"}),
+	)
+
+	var (
+		lastSuccess = regexp.MustCompile(`(?m)^conntrack_stats_last_success_timestamp_seconds\{netns=""} (\S+)$`)
+		duration    = regexp.MustCompile(`(?m)^conntrack_stats_scrape_duration_seconds\{netns="(invalid)?"} \S+$`)
+		invalid     = regexp.MustCompile(`(?m)^conntrack_stats_last_success_timestamp_seconds\{netns="invalid"}`)
+		success     string
+	)
+
+	for i, want := range []string{"1", "0", "1"} {
+		body := scrape(t, handler)
+
+		for _, regex := range []*regexp.Regexp{
+			regexp.MustCompile(`(?m)^conntrack_stats_up\{netns=""} ` + want + `$`),
+			regexp.MustCompile(`(?m)^conntrack_stats_up\{netns="invalid"} 0$`),
+		} {
+			if !regex.Match(body) {
+				t.Errorf("scrape %d: expected response to match %s, but didn't", i, regex)
+			}
+		}
+
+		if got := len(duration.FindAll(body, -1)); got != 2 {
+			t.Errorf("scrape %d: expected 2 scrape durations, got %d", i, got)
+		}
+
+		if invalid.Match(body) {
+			t.Errorf("scrape %d: expected no last success of an invalid netns", i)
+		}
+
+		match := lastSuccess.FindSubmatch(body)
+		if match == nil {
+			t.Fatalf("scrape %d: expected to find the last success, but didn't:\n%s", i, body)
+		}
+
+		switch {
+		case want == "0" && string(match[1]) != success:
+			t.Errorf("scrape %d: expected the last success to stay at %s, got %s", i, success, match[1])
+		case want == "1" && string(match[1]) == success:
+			t.Errorf("scrape %d: expected the last success to be updated", i)
+		}
+
+		success = string(match[1])
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// manyNetns returns n netns labeled ns000 and up in reverse order, all of them
+// the netns of the test process.
+func manyNetns(n int) []string {
+	netns := make([]string, n)
+	for i := range n {
+		netns[n-1-i] = fmt.Sprintf("ns%03d=pid:%d", i, os.Getpid())
+	}
+
+	return netns
+}
+
+// manyCPUs returns stats of n CPUs.
+func manyCPUs(n int) exporter.Stats {
+	stats := exporter.Stats{Count: 42}
+
+	for cpu := range n {
+		stats.CPUs = append(stats.CPUs, exporter.CPUStats{
+			CPU:      cpu,
+			Counters: map[string]uint64{"found": 1, "insert": 2, "insert_failed": 3, "drop": 4, "early_drop": 5},
+		})
+	}
+
+	return stats
+}
+
+func TestManyNetnsSorted(t *testing.T) {
+	body := scrape(t, exporter.Handler(
+		exporter.WithSource(fakeSource{stats: manyCPUs(4)}),
+		exporter.WithNetNs(manyNetns(20)),
+		exporter.WithParallelism(4),
+	))
+
+	var want, got []byte
+
+	for i := range 20 {
+		want = fmt.Appendf(want, "conntrack_stats_count{netns=%q} 42\n", fmt.Sprintf("ns%03d", i))
+	}
+
+	for _, line := range regexp.MustCompile(`(?m)^conntrack_stats_count\{.*\n`).FindAll(body, -1) {
+		got = append(got, line...)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected the samples sorted by netns:\n%s\ngot:\n%s", want, got)
+	}
+}
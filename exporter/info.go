@@ -0,0 +1,136 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// buildInfo returns the labels of the build_info metric.
+var buildInfo = sync.OnceValue(func() internal.Labels {
+	var (
+		version  = "unknown"
+		revision = "unknown"
+	)
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Version != "" {
+			version = bi.Main.Version
+		}
+
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+
+	return internal.Labels{
+		internal.Label{Key: "version", Value: version},
+		internal.Label{Key: "revision", Value: revision},
+		internal.Label{Key: "goversion", Value: runtime.Version()},
+	}
+})
+
+// toolInfo is the version of the conntrack tool.  It is looked up again
+// whenever the executable found in $PATH changes, e.g. on an upgrade of
+// conntrack-tools.  A failure to look it up is remembered just the same.
+type toolInfo struct {
+	mu sync.Mutex
+
+	path    string
+	modTime time.Time
+	version string
+}
+
+// toolVersion returns the version of the conntrack tool, or the empty string
+// if it can't be determined.
+func (e *exporter) toolVersion(ctx context.Context) string {
+	path, err := exec.LookPath("conntrack")
+	if err != nil {
+		return ""
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	e.toolInfo.mu.Lock()
+	defer e.toolInfo.mu.Unlock()
+
+	if path == e.toolInfo.path && stat.ModTime().Equal(e.toolInfo.modTime) {
+		return e.toolInfo.version
+	}
+
+	var version string
+
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			// not the fault of the tool, so try again next time
+			return ""
+		}
+
+		e.logger.ErrorContext(
+			ctx,
+			"error getting the version of the conntrack tool",
+			slog.String("path", path),
+			slog.Any("error", err),
+		)
+	} else {
+		version = parseToolVersion(out)
+
+		if e.toolInfo.version != version {
+			e.logger.InfoContext(ctx, "using conntrack tool", slog.String("path", path), slog.String("version", version))
+		}
+	}
+
+	e.toolInfo.path, e.toolInfo.modTime, e.toolInfo.version = path, stat.ModTime(), version
+
+	return version
+}
+
+// parseToolVersion parses the output of `conntrack --version`, e.g.
+// "conntrack v1.4.7 (conntrack-tools)".
+func parseToolVersion(out []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(out), []byte("\n"))
+
+	if fields := strings.Fields(string(line)); len(fields) >= 2 && fields[0] == "conntrack" {
+		return fields[1]
+	}
+
+	return string(line)
+}
+
+// usesTool reports whether the metrics are read by the conntrack tool.
+func (e *exporter) usesTool() bool {
+	_, ok := e.cfg.source.(toolSource)
+
+	return ok
+}
@@ -0,0 +1,167 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestBuildInfo(t *testing.T) {
+	body := scrape(t, exporter.Handler(exporter.WithSource(fakeSource{})))
+
+	regex := regexp.MustCompile(
+		`(?m)^conntrack_stats_build_info\{version="[^"]+",revision="[^"]+",goversion="` +
+			regexp.QuoteMeta(runtime.Version()) + `"} 1$`,
+	)
+	if !regex.Match(body) {
+		t.Errorf("expected response to match %s, but didn't", regex)
+	}
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_tool_info`).Match(body) {
+		t.Error("expected no tool info without the conntrack tool source")
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+func TestBuildInfoConstLabels(t *testing.T) {
+	body := scrape(t, exporter.Handler(
+		exporter.WithSource(fakeSource{}),
+		exporter.WithConstLabels(map[string]string{"version": "x", "goversion": "y", "node": "n1"}),
+	))
+
+	regex := regexp.MustCompile(
+		`(?m)^conntrack_stats_build_info\{version="[^"]+",revision="[^"]+",goversion="` +
+			regexp.QuoteMeta(runtime.Version()) + `",node="n1"} 1$`,
+	)
+	if !regex.Match(body) {
+		t.Errorf("expected the const labels named like labels of build_info to be dropped, %s, got:\n%s", regex, body)
+	}
+
+	if regexp.MustCompile(`version="x"|goversion="y"`).Match(body) {
+		t.Errorf("expected no sample with the const labels version or goversion, got:\n%s", body)
+	}
+}
+
+func TestToolInfo(t *testing.T) {
+	mockConntrackTool(t)
+
+	handler := exporter.Handler(exporter.WithErrorLogger(t.Logf))
+
+	body := scrape(t, handler)
+
+	want := regexp.MustCompile(`(?m)^conntrack_stats_tool_info\{version="v0.0.0-mock"} 1$`)
+	if !want.Match(body) {
+		t.Errorf("expected response to match %s, but didn't:\n%s", want, body)
+	}
+
+	// upgrade conntrack-tools
+	mock, err := exec.LookPath("conntrack")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	script := "#!/bin/sh\n" +
+		`if [ "$1" = --version ]; then echo "conntrack v1.4.8 (conntrack-tools)"; exit; fi` + "\n" +
+		`exec "` + mock + `" "$@"` + "\n"
+
+	if err := os.WriteFile(filepath.Join(dir, "conntrack"), []byte(script), 0o755); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	body = scrape(t, handler)
+
+	want = regexp.MustCompile(`(?m)^conntrack_stats_tool_info\{version="v1.4.8"} 1$`)
+	if !want.Match(body) {
+		t.Errorf("expected response to match %s, but didn't:\n%s", want, body)
+	}
+}
+
+func TestInfoFixMetricNames(t *testing.T) {
+	mockConntrackTool(t)
+
+	body := scrape(t, exporter.Handler(exporter.WithFixMetricNames()))
+
+	for _, want := range []string{
+		`(?m)^conntrack_stats_build_info\{`,
+		`(?m)^conntrack_stats_tool_info\{version="v0.0.0-mock"} 1$`,
+		`(?m)^conntrack_stats_count_current\{`,
+	} {
+		if !regexp.MustCompile(want).Match(body) {
+			t.Errorf("expected response to match %s, but didn't:\n%s", want, body)
+		}
+	}
+}
+
+func TestToolInfoFailure(t *testing.T) {
+	mockConntrackTool(t)
+
+	mock, err := exec.LookPath("conntrack")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		dir   = t.TempDir()
+		calls = filepath.Join(dir, "calls")
+	)
+
+	script := "#!/bin/sh\n" +
+		`if [ "$1" = --version ]; then echo >> "` + calls + `"; exit 1; fi` + "\n" +
+		`exec "` + mock + `" "$@"` + "\n"
+
+	if err := os.WriteFile(filepath.Join(dir, "conntrack"), []byte(script), 0o755); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	handler := exporter.Handler(exporter.WithNetNs([]string{"", "other=path:/proc/self/ns/net"}))
+
+	var body []byte
+
+	for range 3 {
+		body = scrape(t, handler)
+	}
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_tool_info`).Match(body) {
+		t.Errorf("expected no tool info, got:\n%s", body)
+	}
+
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(content), "\n"); n != 1 {
+		t.Errorf("expected the version to be looked up once, but was looked up %d times", n)
+	}
+}
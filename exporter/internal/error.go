@@ -17,30 +17,47 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Err struct {
-	op  op
+	op  Op
 	err error
 }
 
 type ScrapeErrors struct {
 	mu sync.Mutex
 
-	counts map[string]map[op]uint64
+	counts map[string]map[Op]*counter
+
+	// lastSuccess is when the metrics of a netns were last gathered without
+	// errors.
+	lastSuccess map[string]time.Time
+
+	// history are the last errors of each netns, oldest first, at most
+	// historySize per netns.
+	history     map[string][]ErrorRecord
+	historySize int
+
+	// ops are the causes the counters of each netns are initialized with.
+	ops []Op
 }
 
-func (s *ScrapeErrors) Count(netns string, op op, err error) Err {
+func (s *ScrapeErrors) Count(netns string, op Op, err error) Err {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.init(netns, op)
 
-	s.counts[netns][op]++
+	s.counts[netns][op].count++
+
+	s.record(netns, op, err)
 
 	return Err{
 		op:  op,
@@ -48,6 +65,77 @@ func (s *ScrapeErrors) Count(netns string, op op, err error) Err {
 	}
 }
 
+// ErrorRecord is an error retained by ScrapeErrors.
+type ErrorRecord struct {
+	Op      Op        `json:"op"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+
+	// Stderr and ExitCode are what the conntrack tool wrote to stderr and
+	// exited with, if it failed.
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+func (s *ScrapeErrors) record(netns string, op Op, err error) {
+	if s.historySize <= 0 {
+		return
+	}
+
+	r := ErrorRecord{Op: op, Message: string(op), Time: time.Now()}
+
+	if err != nil {
+		r.Message = err.Error()
+	}
+
+	var errTool *ToolError
+	if errors.As(err, &errTool) {
+		r.Stderr, r.ExitCode = errTool.Stderr, errTool.ExitCode
+
+		// the stderr is a field of its own
+		r.Message = strings.Replace(r.Message, errTool.Error(), errTool.run(), 1)
+	}
+
+	history := append(s.history[netns], r)
+	if len(history) > s.historySize {
+		history = slices.Delete(history, 0, len(history)-s.historySize)
+	}
+
+	s.history[netns] = history
+}
+
+// Errors returns the retained errors by netns, oldest first.
+func (s *ScrapeErrors) Errors() map[string][]ErrorRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make(map[string][]ErrorRecord, len(s.history))
+	for netns, history := range s.history {
+		errs[netns] = slices.Clone(history)
+	}
+
+	return errs
+}
+
+// Success records that the metrics of netns were gathered without errors at t.
+func (s *ScrapeErrors) Success(netns string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSuccess[netns] = t
+}
+
+// LastSuccess returns when the metrics of netns were last gathered without
+// errors.  It reports false if they never were.
+func (s *ScrapeErrors) LastSuccess(netns string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.lastSuccess[netns]
+
+	return t, ok
+}
+
 func (s *ScrapeErrors) Samples() Samples {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -55,7 +143,7 @@ func (s *ScrapeErrors) Samples() Samples {
 	samples := make(Samples, 0, len(s.counts))
 
 	for netns, causes := range s.counts {
-		for cause, count := range causes {
+		for cause, c := range causes {
 			samples = append(
 				samples,
 				Sample{
@@ -69,7 +157,8 @@ func (s *ScrapeErrors) Samples() Samples {
 							Value: string(cause),
 						},
 					},
-					Value: strconv.FormatUint(count, 10),
+					Value:   strconv.FormatUint(c.count, 10),
+					Created: c.created,
 				},
 			)
 		}
@@ -80,32 +169,76 @@ func (s *ScrapeErrors) Samples() Samples {
 	return samples
 }
 
-func (s *ScrapeErrors) init(netns string, cause op) {
+func (s *ScrapeErrors) init(netns string, cause Op) {
 	if s.counts[netns] == nil {
-		s.counts[netns] = make(map[op]uint64)
+		s.counts[netns] = make(map[Op]*counter)
 	}
 
 	if _, ok := s.counts[netns][cause]; !ok {
-		s.counts[netns][cause] = 0
+		s.counts[netns][cause] = &counter{created: time.Now()}
+	}
+}
+
+// counter is a scrape error counter and the time it was initialized.
+type counter struct {
+	count   uint64
+	created time.Time
+}
+
+// Successor returns new scrape errors like NewScrapeErrors and carries over
+// the counters, last successes and retained errors of the netns from s.  The
+// counters of causes not in sourceOps or the common ones are dropped.  Later
+// changes to s do not affect the successor.
+func (s *ScrapeErrors) Successor(netns []string, sourceOps []Op, historySize int) *ScrapeErrors {
+	next := NewScrapeErrors(netns, sourceOps, historySize)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ns := range netns {
+		for op, c := range s.counts[ns] {
+			if slices.Contains(next.ops, op) {
+				next.counts[ns][op] = &counter{count: c.count, created: c.created}
+			}
+		}
+
+		if t, ok := s.lastSuccess[ns]; ok {
+			next.lastSuccess[ns] = t
+		}
+
+		if history := s.history[ns]; len(history) > 0 && historySize > 0 {
+			next.history[ns] = slices.Clone(history[max(len(history)-historySize, 0):])
+		}
 	}
+
+	return next
 }
 
-func NewScrapeErrors(netns []string) *ScrapeErrors {
+// NewScrapeErrors initializes the counters of all netns for the common causes
+// and for the causes specific to the source in use, sourceOps.  The last
+// historySize errors of each netns are retained.
+func NewScrapeErrors(netns []string, sourceOps []Op, historySize int) *ScrapeErrors {
 	s := &ScrapeErrors{
-		counts: make(map[string]map[op]uint64, len(netns)),
+		counts:      make(map[string]map[Op]*counter, len(netns)),
+		lastSuccess: make(map[string]time.Time, len(netns)),
+		history:     make(map[string][]ErrorRecord),
+		historySize: historySize,
+		ops: append(
+			[]Op{
+				OpNetnsRestore,
+				OpNetnsEnter,
+				OpNetnsCleanup,
+				OpNetnsPrepare,
+				OpSysctlRead,
+				OpTimeout,
+				OpClientGone,
+			},
+			sourceOps...,
+		),
 	}
 
 	for _, ns := range netns {
-		for _, cause := range []op{
-			OpNetnsRestore,
-			OpNetnsEnter,
-			OpNetnsCleanup,
-			OpNetnsPrepare,
-			OpExecTool,
-			OpToolOutputNoMatch,
-			OpTimeout,
-			OpClientGone,
-		} {
+		for _, cause := range s.ops {
 			s.init(ns, cause)
 		}
 	}
@@ -113,18 +246,63 @@ func NewScrapeErrors(netns []string) *ScrapeErrors {
 	return s
 }
 
-type op string
+// Retain drops the counters of all netns that are not in netns and
+// initializes the counters of new ones, so the number of samples stays bounded
+// while netns come and go.
+func (s *ScrapeErrors) Retain(netns []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep := make(map[string]struct{}, len(netns))
+
+	for _, ns := range netns {
+		keep[ns] = struct{}{}
+
+		for _, cause := range s.ops {
+			s.init(ns, cause)
+		}
+	}
+
+	for ns := range s.counts {
+		if _, ok := keep[ns]; !ok {
+			delete(s.counts, ns)
+		}
+	}
+
+	for ns := range s.lastSuccess {
+		if _, ok := keep[ns]; !ok {
+			delete(s.lastSuccess, ns)
+		}
+	}
+
+	for ns := range s.history {
+		if _, ok := keep[ns]; !ok {
+			delete(s.history, ns)
+		}
+	}
+}
+
+type Op string
 
 const (
-	OpNetnsRestore op = "netns_restore"
-	OpNetnsEnter   op = "netns_enter"
-	OpNetnsCleanup op = "netns_cleanup"
-	OpNetnsPrepare op = "netns_prepare"
-
-	OpExecTool          op = "tool_exec"
-	OpToolOutputNoMatch op = "tool_output_no_match"
-	OpTimeout           op = "timeout"
-	OpClientGone        op = "client_gone"
+	OpNetnsRestore Op = "netns_restore"
+	OpNetnsEnter   Op = "netns_enter"
+	OpNetnsCleanup Op = "netns_cleanup"
+	OpNetnsPrepare Op = "netns_prepare"
+
+	OpExecTool          Op = "tool_exec"
+	OpToolOutputNoMatch Op = "tool_output_no_match"
+	OpProcfsRead        Op = "procfs_read"
+	OpProcfsParse       Op = "procfs_parse"
+	OpNetlink           Op = "netlink"
+	OpSource            Op = "source"
+	OpSysctlRead        Op = "sysctl_read"
+	OpTimeout           Op = "timeout"
+	OpClientGone        Op = "client_gone"
+
+	OpToolPermissionDenied  Op = "tool_permission_denied"
+	OpToolModuleNotLoaded   Op = "tool_module_not_loaded"
+	OpToolUnsupportedOption Op = "tool_unsupported_option"
 )
 
 func (e Err) OpPriority(other *Err) bool {
@@ -146,6 +324,44 @@ func (e Err) OpPriority(other *Err) bool {
 	return prior(e) < prior(*other)
 }
 
+// ToolError is the error of a failed run of the conntrack tool.
+type ToolError struct {
+	Args []string
+
+	// ExitCode is -1 if the tool did not exit, e.g. was not found or killed.
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *ToolError) Error() string {
+	msg := e.run()
+
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+
+	return msg
+}
+
+// run describes the failed run without the stderr.
+func (e *ToolError) run() string {
+	return fmt.Sprintf("conntrack %s: %v", strings.Join(e.Args, " "), e.Err)
+}
+
+func (e *ToolError) Unwrap() error { return e.Err }
+
+// Stderr returns what the conntrack tool wrote to stderr, if it failed.
+func (e Err) Stderr() string {
+	var errTool *ToolError
+	if errors.As(e.err, &errTool) {
+		return errTool.Stderr
+	}
+
+	return ""
+}
+
+func (e Err) Op() Op        { return e.op }
 func (e Err) Error() string { return fmt.Sprintf("op(%s): %v", e.op, e.err) }
 func (e Err) Unwrap() error { return e.err }
 func (e Err) label() Label  { return Label{Key: "cause", Value: string(e.op)} }
@@ -3,19 +3,29 @@ package internal
 import (
 	"cmp"
 	_ "embed"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"slices"
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type (
 	Metrics struct {
 		metrics        metrics
 		fixMetricNames bool
+		filter         Filter
+		constLabels    Labels
 	}
 
+	// Filter reports whether to include the metric with the given short name.
+	// The sum of a counter over all CPUs has the short name of the counter.
+	Filter func(metricName string) bool
+
 	// metrics is a map from the metric short name to a Metric.
 	metrics map[string]*Metric
 
@@ -23,6 +33,10 @@ type (
 		Name string
 		Help string
 		Type string
+		Unit string
+
+		// constLabels are appended to the labels of every sample.
+		constLabels Labels
 
 		Samples Samples
 	}
@@ -32,6 +46,10 @@ type (
 	Sample struct {
 		Labels Labels
 		Value  string
+
+		// Created is when a counter started counting, if known.  Only the
+		// OpenMetrics format exposes it.
+		Created time.Time
 	}
 
 	Labels []Label
@@ -42,20 +60,28 @@ type (
 	}
 )
 
-func NewMetrics(fixMetricNames bool) Metrics {
+// NewMetrics returns empty metrics.  Metrics excluded by filter are never
+// added; a nil filter includes all metrics.  The constLabels are appended to
+// the labels of every sample.
+func NewMetrics(fixMetricNames bool, filter Filter, constLabels Labels) Metrics {
 	return Metrics{
 		metrics:        make(metrics, len(_help)),
 		fixMetricNames: fixMetricNames,
+		filter:         filter,
+		constLabels:    constLabels,
 	}
 }
 
+// GetOrInit returns the metric with the given short name, creating it if
+// necessary.  If the metric is excluded by the filter, the samples added to
+// the metric returned are dropped.
 func (mm Metrics) GetOrInit(prefix, metricType, metricName string) *Metric {
 	if _, ok := mm.metrics[metricName]; ok {
 		return mm.metrics[metricName]
 	}
 
 	var suffix string
-	if mm.fixMetricNames {
+	if mm.fixMetricNames && !namedRight(metricName) {
 		suffix = "_total"
 
 		if metricType == "gauge" {
@@ -65,16 +91,98 @@ func (mm Metrics) GetOrInit(prefix, metricType, metricName string) *Metric {
 
 	m := &Metric{
 		Name: prefix + "_" + metricName + suffix,
-		Help: _help[metricName],
+		Help: help(metricName),
 		Type: metricType,
+		Unit: _units[metricName],
+
+		constLabels: mm.constLabels,
 	}
 
-	mm.metrics[metricName] = m
+	if mm.includes(metricName) {
+		mm.metrics[metricName] = m
+	}
 
 	return m
 }
 
+// namedRight reports whether the metric was named right from the start, so
+// fixing the historic metric names leaves it alone.  Info metrics must end
+// with _info and metrics with a unit with the unit; up is named like the up
+// metric of Prometheus.
+func namedRight(metricName string) bool {
+	return strings.HasSuffix(metricName, "_info") || _units[metricName] != "" || metricName == "up"
+}
+
+func (mm Metrics) includes(metricName string) bool {
+	return mm.filter == nil || mm.filter(baseName(metricName))
+}
+
+// Select returns a copy of mm with only the metrics with the given short
+// names.  The metrics themselves are shared.
+func (mm Metrics) Select(metricNames []string) Metrics {
+	selected := Metrics{
+		metrics:        make(metrics, len(metricNames)),
+		fixMetricNames: mm.fixMetricNames,
+		filter:         mm.filter,
+		constLabels:    mm.constLabels,
+	}
+
+	for name, m := range mm.metrics {
+		if slices.Contains(metricNames, baseName(name)) {
+			selected.metrics[name] = m
+		}
+	}
+
+	return selected
+}
+
+// baseName returns the short name of the counter of a sum over all CPUs.
+func baseName(metricName string) string {
+	name, _ := strings.CutSuffix(metricName, SumSuffix)
+
+	return name
+}
+
+// Clone returns a copy of mm, to which metrics can be added without
+// modifying mm.  The metrics themselves are shared.
+func (mm Metrics) Clone() Metrics {
+	return Metrics{
+		metrics:        maps.Clone(mm.metrics),
+		fixMetricNames: mm.fixMetricNames,
+		filter:         mm.filter,
+		constLabels:    mm.constLabels,
+	}
+}
+
+// Merge adds the metrics and samples of other to mm.  Other must not be used
+// afterwards.  The samples are left unsorted, see Sort.
+func (mm Metrics) Merge(other Metrics) {
+	for name, m := range other.metrics {
+		existing, ok := mm.metrics[name]
+		if !ok {
+			mm.metrics[name] = m
+
+			continue
+		}
+
+		existing.Samples = append(existing.Samples, m.Samples...)
+	}
+}
+
+// Sort sorts the samples of every metric, which are added in no particular
+// order.  It must be called once all samples are added and before the metrics
+// are written.
+func (mm Metrics) Sort() {
+	for _, m := range mm.metrics {
+		slices.SortFunc(m.Samples, SamplesCmp)
+	}
+}
+
 func (mm Metrics) GatherScrapeErrors(prefix string, scrapeErrors *ScrapeErrors) {
+	if !mm.includes("scrape_error") {
+		return
+	}
+
 	var suffix string
 
 	if mm.fixMetricNames {
@@ -88,6 +196,10 @@ func (mm Metrics) GatherScrapeErrors(prefix string, scrapeErrors *ScrapeErrors)
 		Samples: scrapeErrors.Samples(),
 	}
 
+	for i := range m.Samples {
+		m.Samples[i].Labels = append(m.Samples[i].Labels, mm.constLabels...)
+	}
+
 	mm.metrics["scrape_error"] = m
 }
 
@@ -122,16 +234,21 @@ func (mm metrics) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func (m *Metric) AddSample(labels Labels, value string) {
-	m.Samples = append(
-		m.Samples,
-		Sample{
-			Labels: labels,
-			Value:  value,
-		},
-	)
+	m.addSample(Sample{Labels: labels, Value: value})
+}
 
-	// TODO: this is doing nothing
-	slices.SortFunc(m.Samples, SamplesCmp)
+// AddCounterSample adds a sample of a counter that started counting at created.
+func (m *Metric) AddCounterSample(labels Labels, value string, created time.Time) {
+	m.addSample(Sample{Labels: labels, Value: value, Created: created})
+}
+
+// addSample adds the sample with the constant labels appended.  The label
+// names are not checked here: they are set by the exporter, and the names of
+// constant labels are checked when they are configured.
+func (m *Metric) addSample(sample Sample) {
+	sample.Labels = append(slices.Clip(sample.Labels), m.constLabels...)
+
+	m.Samples = append(m.Samples, sample)
 }
 
 func (m *Metric) WriteTo(w io.Writer) (n int64, err error) {
@@ -150,8 +267,34 @@ func (ll Labels) String() string {
 	return strings.Join(labels, ",")
 }
 
+// String renders the label as in the exposition formats, with the value
+// escaped.  Invalid UTF-8 in the value is replaced by U+FFFD.
 func (l Label) String() string {
-	return l.Key + `="` + l.Value + `"`
+	return l.Key + `="` + _labelValueEscaper.Replace(strings.ToValidUTF8(l.Value, "\uFFFD")) + `"`
+}
+
+var _labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// CheckLabelName returns an error if name is not a valid label name.  Names
+// starting with __ are reserved for internal use by Prometheus.
+func CheckLabelName(name string) error {
+	if name == "" {
+		return errors.New("empty label name")
+	}
+
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name %q is reserved", name)
+	}
+
+	for i, r := range name {
+		if r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || i > 0 && '0' <= r && r <= '9' {
+			continue
+		}
+
+		return fmt.Errorf("invalid label name %q", name)
+	}
+
+	return nil
 }
 
 func SamplesCmp(i, j Sample) int {
@@ -175,17 +318,59 @@ func SamplesCmp(i, j Sample) int {
 
 // TODO(jwkohnen): improve help texts!
 var _help = map[string]string{
-	"found":          "Total of conntrack found",
-	"invalid":        "Total of conntrack invalid",
-	"ignore":         "Total of conntrack ignore",
-	"insert":         "Total of conntrack insert",
-	"insert_failed":  "Total of conntrack insert_failed",
-	"drop":           "Total of conntrack drop",
-	"early_drop":     "Total of conntrack early_drop",
-	"error":          "Total of conntrack error",
-	"search_restart": "Total of conntrack search_restart",
-	"count":          "Total of conntrack count",
-	"scrape_error":   "Total of error when calling/parsing conntrack command",
+	"found":                "Total of conntrack found",
+	"invalid":              "Total of conntrack invalid",
+	"ignore":               "Total of conntrack ignore",
+	"insert":               "Total of conntrack insert",
+	"insert_failed":        "Total of conntrack insert_failed",
+	"drop":                 "Total of conntrack drop",
+	"early_drop":           "Total of conntrack early_drop",
+	"error":                "Total of conntrack error",
+	"search_restart":       "Total of conntrack search_restart",
+	"searched":             "Total of conntrack searched",
+	"new":                  "Total of conntrack new",
+	"delete":               "Total of conntrack delete",
+	"delete_list":          "Total of conntrack delete_list",
+	"clash_resolve":        "Total of conntrack clash_resolve",
+	"chaintoolong":         "Total of conntrack chaintoolong",
+	"expect_new":           "Total of conntrack expect_new",
+	"expect_create":        "Total of conntrack expect_create",
+	"expect_delete":        "Total of conntrack expect_delete",
+	"count":                "Total of conntrack count",
+	"max":                  "Maximum number of conntrack entries (net.netfilter.nf_conntrack_max)",
+	"buckets":              "Size of the conntrack hash table (net.netfilter.nf_conntrack_buckets)",
+	"expect_max":           "Maximum number of conntrack expectations (net.netfilter.nf_conntrack_expect_max)",
+	"fill_ratio":           "Ratio of conntrack count to nf_conntrack_max",
+	"scrape_error":         "Total of error when calling/parsing conntrack command",
+	"snapshot_age_seconds": "Seconds since the metrics served were gathered in the background",
+	"scrape_coalesced":     "Total of scrapes served by the gathering of a concurrent scrape",
+	"build_info":           "Build information of the exporter, the value is always 1",
+	"tool_info":            "Version of the conntrack tool, the value is always 1",
+
+	"up":                             "Whether the metrics of the netns were gathered without errors",
+	"scrape_duration_seconds":        "Seconds it took to gather the metrics of the netns",
+	"last_success_timestamp_seconds": "Unix time the metrics of the netns were last gathered without errors",
+}
+
+// SumSuffix is appended to the short name of a counter summed over all CPUs.
+const SumSuffix = "_all_cpus"
+
+func help(metricName string) string {
+	if name, ok := strings.CutSuffix(metricName, SumSuffix); ok {
+		return _help[name] + ", summed over all CPUs"
+	}
+
+	return _help[metricName]
+}
+
+// _units are the units of the metrics whose names end with one, see the UNIT
+// metadata of OpenMetrics.
+var _units = map[string]string{
+	"fill_ratio":           "ratio",
+	"snapshot_age_seconds": "seconds",
+
+	"scrape_duration_seconds":        "seconds",
+	"last_success_timestamp_seconds": "seconds",
 }
 
 type countWriter struct {
@@ -0,0 +1,120 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	_ "embed"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WriteOpenMetricsTo writes the metrics in the OpenMetrics 1.0 text format.
+func (mm Metrics) WriteOpenMetricsTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(mm.metrics))
+	for name := range mm.metrics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	cw := countWriter{w: w}
+
+	for _, name := range names {
+		m := mm.metrics[name]
+
+		if len(m.Samples) == 0 {
+			continue
+		}
+
+		if err := _openMetricsTmpl.Execute(&cw, newFamily(m)); err != nil {
+			return cw.count, err
+		}
+	}
+
+	_, err := io.WriteString(&cw, "# EOF\n")
+
+	return cw.count, err
+}
+
+// family is a metric as an OpenMetrics metric family.
+type family struct {
+	Name string
+	Help string
+	Type string
+	Unit string
+
+	Samples []familySample
+}
+
+type familySample struct {
+	Name    string
+	Labels  Labels
+	Value   string
+	Created string
+}
+
+func newFamily(m *Metric) family {
+	f := family{
+		Name:    m.Name,
+		Help:    m.Help,
+		Type:    m.Type,
+		Samples: make([]familySample, len(m.Samples)),
+	}
+
+	// The samples of a counter are suffixed with _total, the family isn't.
+	sampleName := m.Name
+	if m.Type == "counter" {
+		f.Name = strings.TrimSuffix(m.Name, "_total")
+		sampleName = f.Name + "_total"
+	}
+
+	// The name of a metric with a unit must end with the unit, which is not
+	// the case with fixed metric names.
+	if m.Unit != "" && strings.HasSuffix(f.Name, "_"+m.Unit) {
+		f.Unit = m.Unit
+	}
+
+	for i, sample := range m.Samples {
+		f.Samples[i] = familySample{
+			Name:   sampleName,
+			Labels: sample.Labels,
+			Value:  sample.Value,
+		}
+
+		if m.Type == "counter" && !sample.Created.IsZero() {
+			f.Samples[i].Created = formatTimestamp(sample.Created)
+		}
+	}
+
+	return f
+}
+
+// formatTimestamp formats t as seconds since the epoch.
+func formatTimestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1e3, 'f', 3, 64)
+}
+
+var (
+	_openMetricsTmpl = template.Must(template.New("openmetrics").Parse(_openMetricsTmplText))
+
+	//go:embed openmetrics.tmpl
+	_openMetricsTmplText string
+)
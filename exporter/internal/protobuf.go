@@ -0,0 +1,187 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field numbers of the io.prometheus.client protobuf messages, see
+// https://github.com/prometheus/client_model/blob/master/io/prometheus/client/metrics.proto.
+const (
+	pbFamilyName   = 1
+	pbFamilyHelp   = 2
+	pbFamilyType   = 3
+	pbFamilyMetric = 4
+	pbFamilyUnit   = 5
+
+	pbMetricLabel   = 1
+	pbMetricGauge   = 2
+	pbMetricCounter = 3
+
+	pbLabelName  = 1
+	pbLabelValue = 2
+
+	pbValue = 1 // of Gauge and Counter
+
+	pbCounterCreated = 3
+
+	pbTimestampSeconds = 1
+	pbTimestampNanos   = 2
+
+	pbTypeCounter = 0
+	pbTypeGauge   = 1
+
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// WriteProtobufTo writes the metrics as length-delimited MetricFamily
+// messages of the Prometheus protobuf format, one family at a time.  Samples
+// whose value does not parse are left out and the first such error is
+// returned after all families are written.
+func (mm Metrics) WriteProtobufTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(mm.metrics))
+	for name := range mm.metrics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var (
+		n      int64
+		buf    []byte
+		family []byte
+		err    error
+	)
+
+	for _, name := range names {
+		m := mm.metrics[name]
+
+		if len(m.Samples) == 0 {
+			continue
+		}
+
+		var errFamily error
+
+		family, errFamily = m.appendProtobuf(family[:0])
+		if err == nil {
+			err = errFamily
+		}
+
+		buf = binary.AppendUvarint(buf[:0], uint64(len(family)))
+		buf = append(buf, family...)
+
+		n2, errWrite := w.Write(buf)
+		n += int64(n2)
+
+		if errWrite != nil {
+			return n, errWrite
+		}
+	}
+
+	return n, err
+}
+
+// appendProtobuf appends m as MetricFamily message.  A sample whose value
+// does not parse is left out and reported.
+func (m *Metric) appendProtobuf(b []byte) ([]byte, error) {
+	var (
+		err       error
+		typ       = pbTypeGauge
+		valueType = pbMetricGauge
+	)
+
+	if m.Type == "counter" {
+		typ, valueType = pbTypeCounter, pbMetricCounter
+	}
+
+	b = appendString(b, pbFamilyName, m.Name)
+	b = appendString(b, pbFamilyHelp, m.Help)
+	b = appendVarint(b, pbFamilyType, uint64(typ))
+
+	for _, sample := range m.Samples {
+		value, errParse := strconv.ParseFloat(sample.Value, 64)
+		if errParse != nil {
+			err = errParse
+
+			continue
+		}
+
+		var metric []byte
+
+		for _, label := range sample.Labels {
+			var pair []byte
+
+			pair = appendString(pair, pbLabelName, label.Key)
+			pair = appendString(pair, pbLabelValue, strings.ToValidUTF8(label.Value, "\uFFFD"))
+
+			metric = appendBytes(metric, pbMetricLabel, pair)
+		}
+
+		var v []byte
+
+		v = appendTag(v, pbValue, wire64Bit)
+		v = binary.LittleEndian.AppendUint64(v, math.Float64bits(value))
+
+		if valueType == pbMetricCounter && !sample.Created.IsZero() {
+			var ts []byte
+
+			ts = appendVarint(ts, pbTimestampSeconds, uint64(sample.Created.Unix()))     //nolint:gosec
+			ts = appendVarint(ts, pbTimestampNanos, uint64(sample.Created.Nanosecond())) //nolint:gosec
+
+			v = appendBytes(v, pbCounterCreated, ts)
+		}
+
+		metric = appendBytes(metric, valueType, v)
+
+		b = appendBytes(b, pbFamilyMetric, metric)
+	}
+
+	// as with OpenMetrics, the name of a metric with a unit must end with it
+	if m.Unit != "" && strings.HasSuffix(m.Name, "_"+m.Unit) {
+		b = appendString(b, pbFamilyUnit, m.Unit)
+	}
+
+	return b, err
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType)) //nolint:gosec
+}
+
+func appendVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+
+	return append(b, v...)
+}
@@ -0,0 +1,78 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// _reservedLabels are the label names the exporter sets itself.
+var _reservedLabels = []string{"netns", "cpu", "cause", "pid", "comm", "cgroup", "version", "revision", "goversion"}
+
+// WithConstLabels adds labels to every sample, e.g. the node or cluster the
+// exporter is running in.  Invalid labels are dropped and logged, use
+// CheckConstLabels to validate them upfront.
+func WithConstLabels(labels map[string]string) Option {
+	return func(cfg *config) { cfg.constLabels = labels }
+}
+
+// CheckConstLabels validates labels as passed to WithConstLabels.
+func CheckConstLabels(labels map[string]string) error {
+	for name := range labels {
+		if err := checkConstLabel(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkConstLabel(name string) error {
+	if err := internal.CheckLabelName(name); err != nil {
+		return err
+	}
+
+	if slices.Contains(_reservedLabels, name) {
+		return fmt.Errorf("label name %q is set by the exporter", name)
+	}
+
+	return nil
+}
+
+// constLabels returns the valid labels of WithConstLabels sorted by name.
+func constLabels(labels map[string]string, logger *slog.Logger) internal.Labels {
+	ll := make(internal.Labels, 0, len(labels))
+
+	for name, value := range labels {
+		if err := checkConstLabel(name); err != nil {
+			logger.Error("dropping constant label", slog.String("label", name), slog.Any("error", err))
+
+			continue
+		}
+
+		ll = append(ll, internal.Label{Key: name, Value: value})
+	}
+
+	slices.SortFunc(ll, func(a, b internal.Label) int { return strings.Compare(a.Key, b.Key) })
+
+	return ll
+}
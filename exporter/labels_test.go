@@ -0,0 +1,217 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestLabelValueEscaping(t *testing.T) {
+	const label = "a\\b\"c\nd"
+
+	for _, accept := range []string{"text/plain", "application/openmetrics-text"} {
+		_, body := scrapeAccept(
+			t,
+			exporter.Handler(
+				exporter.WithSource(fakeSource{}),
+				exporter.WithNetNs([]string{label + "=path:/nonexistent"}),
+				exporter.WithOpenMetrics(),
+			),
+			accept,
+		)
+
+		want := []byte(`{netns="a\\b\"c\nd",cause="netns_prepare"} 1`)
+		if !bytes.Contains(body, want) {
+			t.Errorf("%s: expected to find %s, but didn't:\n%s", accept, want, body)
+		}
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	labels := map[string]string{"node": "n1", "cluster": "c1", "netns": "dropped", "0invalid": "dropped"}
+
+	body := scrape(
+		t,
+		exporter.Handler(
+			exporter.WithSource(fakeSource{stats: testStats}),
+			exporter.WithAggregation(exporter.AggregateBoth),
+			exporter.WithConstLabels(labels),
+		),
+	)
+
+	for _, want := range []string{
+		`conntrack_stats_count{netns="",cluster="c1",node="n1"} 42`,
+		`conntrack_stats_drop{cpu="0",netns="",cluster="c1",node="n1"} 4`,
+		`conntrack_stats_drop_all_cpus{netns="",cluster="c1",node="n1"} 4`,
+		`conntrack_stats_scrape_error{netns="",cause="source",cluster="c1",node="n1"} 0`,
+	} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("expected to find %s, but didn't", want)
+		}
+	}
+
+	if bytes.Contains(body, []byte("dropped")) {
+		t.Errorf("expected invalid labels to be dropped")
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+
+	for _, tc := range []struct {
+		labels map[string]string
+		valid  bool
+	}{
+		{map[string]string{"node": "n1", "cluster": ""}, true},
+		{map[string]string{"netns": "x"}, false},
+		{map[string]string{"version": "x"}, false},
+		{map[string]string{"revision": "x"}, false},
+		{map[string]string{"goversion": "x"}, false},
+		{map[string]string{"__name__": "x"}, false},
+		{map[string]string{"a-b": "x"}, false},
+		{map[string]string{"": "x"}, false},
+	} {
+		if err := exporter.CheckConstLabels(tc.labels); (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid %v, got error %v", tc.labels, tc.valid, err)
+		}
+	}
+}
+
+// FuzzLabelValues feeds arbitrary netns labels through the handler and checks
+// they are parsed back from the output unharmed.
+func FuzzLabelValues(f *testing.F) {
+	for _, seed := range []string{"foo", "", `\`, `"`, "\n", `a\"b`, "}", `{a="b"}`, "\xff", "ü"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, label string) {
+		for _, kind := range []string{"=name:", "=path:", "=pid:"} {
+			if strings.Contains(label, kind) {
+				t.Skip("label must not contain a netns spec")
+			}
+		}
+
+		handler := exporter.Handler(
+			exporter.WithSource(fakeSource{}),
+			exporter.WithNetNs([]string{label + "=path:/nonexistent"}),
+			exporter.WithOpenMetrics(),
+		)
+
+		for _, accept := range []string{"text/plain", "application/openmetrics-text"} {
+			_, body := scrapeAccept(t, handler, accept)
+
+			var samples int
+
+			scanner := bufio.NewScanner(bytes.NewReader(body))
+			for scanner.Scan() {
+				line := scanner.Text()
+				if !strings.HasPrefix(line, "conntrack_stats_scrape_error") {
+					continue
+				}
+
+				labels, err := parseLabels(line)
+				if err != nil {
+					t.Fatalf("%s: %v: %q", accept, err, line)
+				}
+
+				if want := strings.ToValidUTF8(label, "\uFFFD"); labels["netns"] != want {
+					t.Fatalf("%s: expected netns label %q, got %q", accept, want, labels["netns"])
+				}
+
+				samples++
+			}
+
+			if samples == 0 {
+				t.Fatalf("%s: expected scrape error samples, but found none:\n%s", accept, body)
+			}
+		}
+	})
+}
+
+// parseLabels parses the labels of a sample line of the text formats.
+func parseLabels(line string) (map[string]string, error) {
+	_, rest, ok := strings.Cut(line, "{")
+	if !ok {
+		return nil, errors.New("no labels")
+	}
+
+	labels := make(map[string]string)
+
+	for {
+		name, after, ok := strings.Cut(rest, `="`)
+		if !ok {
+			return nil, errors.New("missing label value")
+		}
+
+		var (
+			value   strings.Builder
+			escaped bool
+			i       int
+		)
+
+	value:
+		for i = 0; i < len(after); i++ {
+			c := after[i]
+
+			switch {
+			case escaped:
+				switch c {
+				case '\\', '"':
+					value.WriteByte(c)
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return nil, errors.New("invalid escape sequence")
+				}
+
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				break value
+			default:
+				value.WriteByte(c)
+			}
+		}
+
+		if i == len(after) {
+			return nil, errors.New("unterminated label value")
+		}
+
+		if !utf8.ValidString(value.String()) {
+			return nil, errors.New("invalid UTF-8")
+		}
+
+		labels[name] = value.String()
+
+		switch rest = after[i+1:]; {
+		case strings.HasPrefix(rest, ","):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "} "):
+			return labels, nil
+		default:
+			return nil, errors.New("malformed labels")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// WithLogger sets the logger.  Errors are logged at level error, changes of
+// the environment like a new version of the conntrack tool at level info, and
+// every execution of the conntrack tool at level debug.  The default discards
+// all logs.
+func WithLogger(logger *slog.Logger) Option { return func(cfg *config) { cfg.slogger = logger } }
+
+// newLogger returns the logger of the config.  A logger set by
+// WithErrorLogger gets the logs at level info and above as text lines.
+func newLogger(cfg config) *slog.Logger {
+	switch {
+	case cfg.slogger != nil:
+		return cfg.slogger
+	case cfg.logger != nil:
+		return slog.New(slog.NewTextHandler(printfWriter(cfg.logger), nil))
+	default:
+		return slog.New(slog.DiscardHandler)
+	}
+}
+
+// printfWriter writes to a printf style logger.
+type printfWriter func(string, ...any)
+
+func (w printfWriter) Write(p []byte) (int, error) {
+	w("%s", p)
+
+	return len(p), nil
+}
+
+var _ io.Writer = printfWriter(nil)
+
+// errAttrs returns the attributes of err to log: the op of an internal.Err as
+// cause, like the label of the scrape_error metric, the error and what the
+// conntrack tool wrote to stderr, if anything.
+func errAttrs(err error) []slog.Attr {
+	var errNs internal.Err
+	if !errors.As(err, &errNs) {
+		return []slog.Attr{slog.Any("error", err)}
+	}
+
+	attrs := []slog.Attr{
+		slog.String("cause", string(errNs.Op())),
+		slog.Any("error", errNs.Unwrap()),
+	}
+
+	var errTool *internal.ToolError
+	if errors.As(err, &errTool) {
+		attrs = append(attrs, slog.String("stderr", errTool.Stderr), slog.Int("exit_code", errTool.ExitCode))
+	}
+
+	return attrs
+}
+
+// logError logs err at level error with the attributes of errAttrs.
+func (e *exporter) logError(ctx context.Context, msg string, err error, attrs ...slog.Attr) {
+	e.logger.LogAttrs(ctx, slog.LevelError, msg, append(attrs, errAttrs(err)...)...)
+}
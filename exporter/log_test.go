@@ -0,0 +1,93 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+func TestLogger(t *testing.T) {
+	mockConntrackTool(t)
+	t.Setenv("CONNTRACK_STATS_EXPORTER_KAPUTT", "true")
+
+	for _, tc := range []struct {
+		level     slog.Level
+		wantDebug bool
+	}{
+		{slog.LevelDebug, true},
+		{slog.LevelInfo, false},
+	} {
+		t.Run(tc.level.String(), func(t *testing.T) {
+			var (
+				buf     = new(bytes.Buffer)
+				handler = exporter.Handler(
+					exporter.WithLogger(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: tc.level}))),
+				)
+			)
+
+			scrape(t, handler)
+
+			var gotDebug, gotError bool
+
+			scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+			for scanner.Scan() {
+				var entry map[string]any
+				if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+					t.Fatal(err)
+				}
+
+				switch entry["msg"] {
+				case "executed conntrack tool":
+					gotDebug = true
+
+					if entry["level"] != "DEBUG" || entry["netns"] != "" || entry["duration"] == nil {
+						t.Errorf("unexpected log entry %v", entry)
+					}
+				case "error gathering metrics":
+					gotError = true
+
+					if entry["level"] != "ERROR" ||
+						entry["netns"] != "" ||
+						entry["cause"] != string(internal.OpExecTool) ||
+						entry["error"] == nil ||
+						entry["stderr"] != "kaputt\n" {
+						t.Errorf("unexpected log entry %v", entry)
+					}
+				}
+			}
+
+			if gotDebug != tc.wantDebug {
+				t.Errorf("expected debug logs %v, got %v", tc.wantDebug, gotDebug)
+			}
+
+			if !gotError {
+				t.Error("expected an error to be logged")
+			}
+
+			if t.Failed() {
+				t.Logf("log:\n%s", buf.Bytes())
+			}
+		})
+	}
+}
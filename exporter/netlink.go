@@ -0,0 +1,399 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// Message types of the ctnetlink subsystem, see
+// include/uapi/linux/netfilter/nfnetlink_conntrack.h.
+const (
+	ipctnlMsgCtGetStatsCPU = 4
+	ipctnlMsgCtGetStats    = 5
+)
+
+// ctaStats is an attribute type of a IPCTNL_MSG_CT_GET_STATS_CPU message
+// (enum ctattr_stats_cpu).
+type ctaStats uint16
+
+const (
+	ctaStatsSearched ctaStats = iota + 1 // no longer used
+	ctaStatsFound
+	ctaStatsNew // no longer used
+	ctaStatsInvalid
+	ctaStatsIgnore     // no longer used
+	ctaStatsDelete     // no longer used
+	ctaStatsDeleteList // no longer used
+	ctaStatsInsert
+	ctaStatsInsertFailed
+	ctaStatsDrop
+	ctaStatsEarlyDrop
+	ctaStatsError
+	ctaStatsSearchRestart
+	ctaStatsClashResolve
+	ctaStatsChainTooLong
+
+	ctaStatsMax = ctaStatsChainTooLong
+)
+
+// Neither struct nfgenmsg nor NLA_TYPE_MASK are provided by x/sys/unix.
+const (
+	sizeofNfgenmsg = 4
+	nlaTypeMask    = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+)
+
+// ctaStatsGlobalEntries is an attribute type of a IPCTNL_MSG_CT_GET_STATS
+// message (enum ctattr_stats_global).
+const ctaStatsGlobalEntries = 1
+
+// _ctaStatsNames maps the attribute types to the metric short names, which are
+// the same names the conntrack tool prints.
+var _ctaStatsNames = [ctaStatsMax + 1]string{
+	ctaStatsSearched:      "searched",
+	ctaStatsFound:         "found",
+	ctaStatsNew:           "new",
+	ctaStatsInvalid:       "invalid",
+	ctaStatsIgnore:        "ignore",
+	ctaStatsDelete:        "delete",
+	ctaStatsDeleteList:    "delete_list",
+	ctaStatsInsert:        "insert",
+	ctaStatsInsertFailed:  "insert_failed",
+	ctaStatsDrop:          "drop",
+	ctaStatsEarlyDrop:     "early_drop",
+	ctaStatsError:         "error",
+	ctaStatsSearchRestart: "search_restart",
+	ctaStatsClashResolve:  "clash_resolve",
+	ctaStatsChainTooLong:  "chaintoolong",
+}
+
+// ctStatsCPU are the conntrack statistics of a single CPU.  Kernels differ in
+// which attributes they report, so only the values flagged in reported are
+// meaningful.
+type ctStatsCPU struct {
+	cpu      uint16
+	values   [ctaStatsMax + 1]uint32
+	reported [ctaStatsMax + 1]bool
+}
+
+// ctStats are the statistics of the conntrack table of a netns.
+type ctStats struct {
+	cpus  []ctStatsCPU
+	count uint32
+}
+
+// NetlinkSource returns a Source that queries the kernel via ctnetlink, so
+// the conntrack tool is not needed.  It requires CAP_NET_ADMIN.
+func NetlinkSource() Source { return netlinkSource{} }
+
+type netlinkSource struct{}
+
+func (netlinkSource) ops() []internal.Op { return []internal.Op{internal.OpNetlink} }
+
+func (netlinkSource) Stats(ctx context.Context, _ string) (Stats, error) {
+	ct, err := getNetlinkStats(ctx)
+	if err != nil {
+		return Stats{}, &opError{
+			op:  internal.OpNetlink,
+			err: fmt.Errorf("failed to get conntrack stats via netlink: %w", err),
+		}
+	}
+
+	stats := Stats{
+		CPUs:  make([]CPUStats, 0, len(ct.cpus)),
+		Count: uint64(ct.count),
+	}
+
+	for _, cpu := range ct.cpus {
+		cpuStats := CPUStats{
+			CPU:      int(cpu.cpu),
+			Counters: make(map[string]uint64, len(_ctaStatsNames)),
+		}
+
+		for attr, metricShortName := range _ctaStatsNames {
+			if cpu.reported[attr] {
+				cpuStats.Counters[metricShortName] = uint64(cpu.values[attr])
+			}
+		}
+
+		stats.CPUs = append(stats.CPUs, cpuStats)
+	}
+
+	return stats, nil
+}
+
+// getNetlinkStats queries the per CPU statistics and the number of entries of
+// the conntrack table via ctnetlink.  The netlink socket is bound to the netns
+// of the calling thread.
+func getNetlinkStats(ctx context.Context) (ctStats, error) {
+	var stats ctStats
+
+	conn, err := dialCtnetlink(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	defer func() { _ = conn.close() }()
+
+	err = conn.query(ipctnlMsgCtGetStatsCPU, unix.NLM_F_DUMP, func(resID uint16, attrs []byte) error {
+		cpu := ctStatsCPU{cpu: resID}
+
+		err := parseAttrs(attrs, func(typ uint16, value []byte) error {
+			if typ == 0 || typ > uint16(ctaStatsMax) {
+				// unknown attribute of a newer kernel
+				return nil
+			}
+
+			if len(value) != 4 {
+				return fmt.Errorf("attribute %d has length %d", typ, len(value))
+			}
+
+			cpu.values[typ] = binary.BigEndian.Uint32(value)
+			cpu.reported[typ] = true
+
+			return nil
+		})
+
+		stats.cpus = append(stats.cpus, cpu)
+
+		return err
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error querying per CPU stats: %w", err)
+	}
+
+	var haveCount bool
+
+	err = conn.query(ipctnlMsgCtGetStats, 0, func(_ uint16, attrs []byte) error {
+		return parseAttrs(attrs, func(typ uint16, value []byte) error {
+			if typ != ctaStatsGlobalEntries {
+				return nil
+			}
+
+			if len(value) != 4 {
+				return fmt.Errorf("attribute %d has length %d", typ, len(value))
+			}
+
+			stats.count = binary.BigEndian.Uint32(value)
+			haveCount = true
+
+			return nil
+		})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error querying global stats: %w", err)
+	}
+
+	if !haveCount {
+		return stats, errors.New("global stats are missing the number of entries")
+	}
+
+	return stats, nil
+}
+
+type ctnetlinkConn struct {
+	fd  int
+	seq uint32
+	buf []byte
+}
+
+func dialCtnetlink(ctx context.Context) (*ctnetlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("error opening netlink socket: %w", err)
+	}
+
+	conn := &ctnetlinkConn{
+		fd:  fd,
+		seq: uint32(time.Now().Unix()), //nolint:gosec
+		buf: make([]byte, 1<<15),
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = conn.close()
+
+		return nil, fmt.Errorf("error binding netlink socket: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			_ = conn.close()
+
+			return nil, context.DeadlineExceeded
+		}
+
+		tv := unix.NsecToTimeval(timeout.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			_ = conn.close()
+
+			return nil, fmt.Errorf("error setting receive timeout of netlink socket: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *ctnetlinkConn) close() error { return unix.Close(c.fd) }
+
+// query sends a ctnetlink request and calls fn for each message of the reply
+// with the res_id of the nfgenmsg header (the CPU of per CPU replies) and the
+// undecoded attributes.
+func (c *ctnetlinkConn) query(msgType uint16, flags uint16, fn func(resID uint16, attrs []byte) error) error {
+	c.seq++
+
+	const reqLen = unix.NLMSG_HDRLEN + sizeofNfgenmsg
+
+	req := make([]byte, reqLen)
+	binary.NativeEndian.PutUint32(req[0:4], reqLen)
+	binary.NativeEndian.PutUint16(req[4:6], unix.NFNL_SUBSYS_CTNETLINK<<8|msgType)
+	binary.NativeEndian.PutUint16(req[6:8], unix.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(req[8:12], c.seq)
+	req[unix.NLMSG_HDRLEN] = unix.AF_UNSPEC
+	req[unix.NLMSG_HDRLEN+1] = unix.NFNETLINK_V0
+
+	if err := ignoringEINTR(func() error {
+		return unix.Sendto(c.fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	}); err != nil {
+		return fmt.Errorf("error sending netlink request: %w", err)
+	}
+
+	dump := flags&unix.NLM_F_DUMP != 0
+
+	for {
+		var n int
+
+		err := ignoringEINTR(func() (err error) {
+			n, _, err = unix.Recvfrom(c.fd, c.buf, 0)
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error receiving netlink reply: %w", err)
+		}
+
+		done, err := c.parseMessages(c.buf[:n], dump, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// ignoringEINTR calls fn until it is not interrupted by a signal.  Since the
+// socket has a receive timeout, interrupted calls are not restarted even with
+// SA_RESTART, see signal(7).
+func ignoringEINTR(fn func() error) error {
+	for {
+		if err := fn(); !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
+
+func (c *ctnetlinkConn) parseMessages(
+	buf []byte,
+	dump bool,
+	fn func(resID uint16, attrs []byte) error,
+) (
+	done bool,
+	err error,
+) {
+	for len(buf) >= unix.NLMSG_HDRLEN {
+		var (
+			msgLen = binary.NativeEndian.Uint32(buf[0:4])
+			typ    = binary.NativeEndian.Uint16(buf[4:6])
+			seq    = binary.NativeEndian.Uint32(buf[8:12])
+		)
+
+		if msgLen < unix.NLMSG_HDRLEN || int(msgLen) > len(buf) {
+			return false, fmt.Errorf("malformed netlink message of length %d", msgLen)
+		}
+
+		payload := buf[unix.NLMSG_HDRLEN:msgLen]
+		buf = buf[min(nlmsgAlign(int(msgLen)), len(buf)):]
+
+		if seq != c.seq {
+			// stray reply of an earlier request
+			continue
+		}
+
+		switch typ {
+		case unix.NLMSG_DONE:
+			return true, nil
+		case unix.NLMSG_ERROR:
+			if len(payload) < 4 {
+				return false, errors.New("truncated netlink error message")
+			}
+
+			if errno := int32(binary.NativeEndian.Uint32(payload[0:4])); errno != 0 { //nolint:gosec
+				return false, unix.Errno(-errno)
+			}
+
+			return true, nil
+		}
+
+		if len(payload) < sizeofNfgenmsg {
+			return false, errors.New("truncated nfnetlink message")
+		}
+
+		resID := binary.BigEndian.Uint16(payload[2:4])
+
+		if err := fn(resID, payload[sizeofNfgenmsg:]); err != nil {
+			return false, err
+		}
+
+		if !dump {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parseAttrs calls fn for each netlink attribute in buf.
+func parseAttrs(buf []byte, fn func(typ uint16, value []byte) error) error {
+	const hdrLen = 4
+
+	for len(buf) >= hdrLen {
+		var (
+			attrLen = int(binary.NativeEndian.Uint16(buf[0:2]))
+			typ     = binary.NativeEndian.Uint16(buf[2:4]) & nlaTypeMask
+		)
+
+		if attrLen < hdrLen || attrLen > len(buf) {
+			return fmt.Errorf("malformed netlink attribute of length %d", attrLen)
+		}
+
+		if err := fn(typ, buf[hdrLen:attrLen]); err != nil {
+			return err
+		}
+
+		buf = buf[min(nlmsgAlign(attrLen), len(buf)):]
+	}
+
+	return nil
+}
+
+func nlmsgAlign(n int) int { return (n + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1) }
@@ -0,0 +1,325 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+// TestNetlink queries the conntrack stats of the kernel the test runs on, so it
+// needs CAP_NET_ADMIN and the nf_conntrack module loaded.
+func TestNetlink(t *testing.T) {
+	var (
+		errorLogBuf = new(bytes.Buffer)
+		body        = scrape(t, exporter.Handler(exporter.WithNetlink(), exporter.WithErrorLogger(logger(errorLogBuf))))
+	)
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{.*?cause="netlink".*?} 1$`).Match(body) {
+		t.Skipf("Skipping test because ctnetlink is not available: %s", errorLogBuf.String())
+	}
+
+	for _, regex := range []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^conntrack_stats_count\{netns=""} \d+$`),
+		regexp.MustCompile(`(?m)^conntrack_stats_found\{cpu="0",netns=""} \d+$`),
+		regexp.MustCompile(`(?m)^conntrack_stats_insert_failed\{cpu="0",netns=""} \d+$`),
+		regexp.MustCompile(`(?m)^conntrack_stats_search_restart\{cpu="0",netns=""} \d+$`),
+	} {
+		if !regex.Match(body) {
+			t.Errorf("expected response to match %s, but didn't", regex)
+		}
+	}
+
+	if t.Failed() {
+		t.Logf("error log:\n%s", errorLogBuf.String())
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+const testSeq = 42
+
+// nlmsg returns a netlink message padded to the alignment.
+func nlmsg(typ uint16, seq uint32, payload []byte) []byte {
+	msg := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload)+unix.NLMSG_ALIGNTO)
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.NLMSG_HDRLEN+len(payload))) //nolint:gosec
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+
+	msg = append(msg, payload...)
+
+	for len(msg)%unix.NLMSG_ALIGNTO != 0 {
+		msg = append(msg, 0)
+	}
+
+	return msg
+}
+
+// nfgenmsg returns the payload of a ctnetlink message of resID with attrs.
+func nfgenmsg(resID uint16, attrs ...[]byte) []byte {
+	payload := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(payload[2:4], resID)
+
+	return slices.Concat(append([][]byte{payload}, attrs...)...)
+}
+
+// nlattr returns a netlink attribute padded to the alignment.
+func nlattr(typ uint16, value []byte) []byte {
+	attr := make([]byte, 4, 4+len(value)+unix.NLA_ALIGNTO)
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(4+len(value))) //nolint:gosec
+	binary.NativeEndian.PutUint16(attr[2:4], typ)
+
+	attr = append(attr, value...)
+
+	for len(attr)%unix.NLA_ALIGNTO != 0 {
+		attr = append(attr, 0)
+	}
+
+	return attr
+}
+
+// nlerr returns the payload of an NLMSG_ERROR message with errno.
+func nlerr(errno unix.Errno) []byte {
+	payload := make([]byte, 4+unix.NLMSG_HDRLEN)
+	binary.NativeEndian.PutUint32(payload[0:4], uint32(-int32(errno))) //nolint:gosec
+
+	return payload
+}
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func TestParseNetlinkMessages(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		buf      []byte
+		dump     bool
+		wantIDs  []uint16
+		wantDone bool
+		wantErr  error
+	}{
+		{
+			name: "dump",
+			buf: slices.Concat(
+				nlmsg(1, testSeq, nfgenmsg(0)),
+				nlmsg(1, testSeq, nfgenmsg(1)),
+				nlmsg(unix.NLMSG_DONE, testSeq, u32(0)),
+			),
+			dump:     true,
+			wantIDs:  []uint16{0, 1},
+			wantDone: true,
+		},
+		{
+			name:    "dump continued in the next buffer",
+			buf:     nlmsg(1, testSeq, nfgenmsg(3)),
+			dump:    true,
+			wantIDs: []uint16{3},
+		},
+		{
+			name:     "single reply",
+			buf:      slices.Concat(nlmsg(1, testSeq, nfgenmsg(7)), nlmsg(1, testSeq, nfgenmsg(8))),
+			wantIDs:  []uint16{7},
+			wantDone: true,
+		},
+		{
+			name: "stray reply",
+			buf: slices.Concat(
+				nlmsg(1, testSeq-1, nfgenmsg(5)),
+				nlmsg(unix.NLMSG_DONE, testSeq-1, u32(0)),
+				nlmsg(1, testSeq, nfgenmsg(6)),
+				nlmsg(unix.NLMSG_DONE, testSeq, u32(0)),
+			),
+			dump:     true,
+			wantIDs:  []uint16{6},
+			wantDone: true,
+		},
+		{
+			name:     "ack",
+			buf:      nlmsg(unix.NLMSG_ERROR, testSeq, nlerr(0)),
+			wantDone: true,
+		},
+		{
+			name:    "error",
+			buf:     nlmsg(unix.NLMSG_ERROR, testSeq, nlerr(unix.EPERM)),
+			wantErr: unix.EPERM,
+		},
+		{
+			name:    "truncated error",
+			buf:     nlmsg(unix.NLMSG_ERROR, testSeq, []byte{1, 2}),
+			wantErr: errAny,
+		},
+		{
+			name:    "truncated message",
+			buf:     nlmsg(1, testSeq, nfgenmsg(0, nlattr(1, u32(1))))[:unix.NLMSG_HDRLEN+4],
+			wantErr: errAny,
+		},
+		{
+			name:    "message shorter than its header",
+			buf:     func() []byte { m := nlmsg(1, testSeq, nfgenmsg(0)); m[0] = 8; return m }(),
+			wantErr: errAny,
+		},
+		{
+			name:    "truncated nfgenmsg",
+			buf:     nlmsg(1, testSeq, []byte{0, 0}),
+			wantErr: errAny,
+		},
+		{
+			name: "trailing bytes shorter than a header",
+			buf:  []byte{1, 2, 3},
+			dump: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ids []uint16
+
+			done, err := exporter.ParseNetlinkMessages(tc.buf, testSeq, tc.dump, func(resID uint16, _ []byte) error {
+				ids = append(ids, resID)
+
+				return nil
+			})
+
+			checkErr(t, err, tc.wantErr)
+
+			if tc.wantErr != nil {
+				return
+			}
+
+			if done != tc.wantDone {
+				t.Errorf("expected done %t, got %t", tc.wantDone, done)
+			}
+
+			if !slices.Equal(ids, tc.wantIDs) {
+				t.Errorf("expected res ids %v, got %v", tc.wantIDs, ids)
+			}
+		})
+	}
+}
+
+func TestParseNetlinkMessagesCallbackError(t *testing.T) {
+	errKaputt := errors.New("kaputt")
+
+	_, err := exporter.ParseNetlinkMessages(
+		nlmsg(1, testSeq, nfgenmsg(0)),
+		testSeq,
+		true,
+		func(uint16, []byte) error { return errKaputt },
+	)
+	if !errors.Is(err, errKaputt) {
+		t.Errorf("expected the error of the callback, got %v", err)
+	}
+}
+
+func TestParseNetlinkAttrs(t *testing.T) {
+	type attr struct {
+		typ   uint16
+		value string
+	}
+
+	for _, tc := range []struct {
+		name    string
+		buf     []byte
+		want    []attr
+		wantErr error
+	}{
+		{
+			name: "attributes",
+			buf:  slices.Concat(nlattr(2, u32(17)), nlattr(3, []byte{1}), nlattr(4, nil)),
+			want: []attr{{2, string(u32(17))}, {3, "\x01"}, {4, ""}},
+		},
+		{
+			name: "flags masked",
+			buf:  nlattr(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER|5, u32(1)),
+			want: []attr{{5, string(u32(1))}},
+		},
+		{
+			name: "unpadded last attribute",
+			buf:  nlattr(6, []byte{1})[:5],
+			want: []attr{{6, "\x01"}},
+		},
+		{
+			name:    "length shorter than header",
+			buf:     func() []byte { a := nlattr(1, u32(1)); a[0] = 2; return a }(),
+			wantErr: errAny,
+		},
+		{
+			name:    "length beyond buffer",
+			buf:     func() []byte { a := nlattr(1, u32(1)); a[0] = 12; return a }(),
+			wantErr: errAny,
+		},
+		{
+			name: "trailing bytes shorter than a header",
+			buf:  slices.Concat(nlattr(1, u32(1)), []byte{0, 0}),
+			want: []attr{{1, string(u32(1))}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []attr
+
+			err := exporter.ParseNetlinkAttrs(tc.buf, func(typ uint16, value []byte) error {
+				got = append(got, attr{typ, string(value)})
+
+				return nil
+			})
+
+			checkErr(t, err, tc.wantErr)
+
+			if tc.wantErr == nil && !slices.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// errAny matches any error in checkErr.
+var errAny = errors.New("any error")
+
+func TestIgnoringEINTR(t *testing.T) {
+	var calls int
+
+	err := exporter.IgnoringEINTR(func() error {
+		calls++
+
+		if calls < 3 {
+			return unix.EINTR
+		}
+
+		return unix.EAGAIN
+	})
+
+	if !errors.Is(err, unix.EAGAIN) || calls != 3 {
+		t.Errorf("expected EAGAIN after 3 calls, got %v after %d", err, calls)
+	}
+}
+
+func checkErr(t *testing.T, err, want error) {
+	t.Helper()
+
+	switch {
+	case want == nil && err != nil:
+		t.Errorf("unexpected error: %v", err)
+	case want == errAny && err == nil: //nolint:errorlint
+		t.Error("expected an error, got none")
+	case want != nil && want != errAny && !errors.Is(err, want): //nolint:errorlint
+		t.Errorf("expected error %v, got %v", want, err)
+	}
+}
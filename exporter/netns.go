@@ -19,32 +19,198 @@ package exporter
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 
 	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
 )
 
-func (e *exporter) execInNetns(name string, fn func()) (err error) {
+// target is a netns the exporter gathers metrics for.
+type target struct {
+	// name is the value of the netns label and identifies the netns in the
+	// scrape errors.  The empty string is the netns of the exporter itself.
+	name string
+
+	// path is the netns file to enter; empty for the netns of the exporter.
+	path string
+
+	// labels are added to the samples of the netns.
+	labels internal.Labels
+
+	// inode identifies the netns of discovered targets.
+	inode uint64
+
+	// err is the reason why a netns set by WithNetNs is invalid.
+	err error
+}
+
+// namedTarget returns the target of a netns named by ip-netns(8).
+func namedTarget(name string) target {
 	if name == "" {
+		return target{}
+	}
+
+	return target{name: name, path: filepath.Join(netnsDir, name)}
+}
+
+// parseTarget parses an entry of WithNetNs, see there.  An invalid entry is
+// returned as a target with err set, so it is reported as scrape error.
+func parseTarget(spec string) target {
+	label, ref, hasLabel := "", spec, false
+
+	for _, kind := range []string{"name:", "path:", "pid:"} {
+		if l, r, ok := strings.Cut(spec, "="+kind); ok {
+			label, ref, hasLabel = l, kind+r, true
+
+			break
+		}
+	}
+
+	var t target
+
+	switch kind, value, _ := strings.Cut(ref, ":"); kind {
+	case "name":
+		t = namedTarget(value)
+
+		if value == "" || strings.Contains(value, "/") {
+			t.err = fmt.Errorf("invalid netns name %q", value)
+		}
+	case "path":
+		t = target{name: ref, path: value}
+
+		if !filepath.IsAbs(value) {
+			t.err = fmt.Errorf("netns path %q is not absolute", value)
+		}
+	case "pid":
+		t = target{name: ref, path: filepath.Join(_procDir, value, "ns", "net")}
+
+		if pid, err := strconv.Atoi(value); err != nil || pid <= 0 {
+			t.err = fmt.Errorf("invalid netns pid %q", value)
+		}
+	default:
+		// a plain name as in ip-netns(8), which is how it used to be
+		t = namedTarget(ref)
+	}
+
+	if hasLabel {
+		t.name = label
+
+		if label == "" {
+			t.err = fmt.Errorf("empty label of netns %q", ref)
+		}
+	}
+
+	return t
+}
+
+// CheckNetNs validates a list of netns as passed to WithNetNs.
+func CheckNetNs(netnsList []string) error {
+	seen := make(map[string]bool, len(netnsList))
+
+	for _, spec := range netnsList {
+		t := parseTarget(spec)
+		if t.err != nil {
+			return t.err
+		}
+
+		if seen[t.name] {
+			return fmt.Errorf("netns label %q is not unique", t.name)
+		}
+
+		seen[t.name] = true
+	}
+
+	return nil
+}
+
+// sampleLabels returns the labels of a sample of the netns: the given labels,
+// the netns label and the labels of the target.
+func (t target) sampleLabels(labels ...internal.Label) internal.Labels {
+	labels = append(labels, internal.Label{Key: "netns", Value: t.name})
+
+	return append(labels, t.labels...)
+}
+
+// openNetns opens the netns of t.  The netns file of a discovered target may
+// refer to another netns by now, e.g. if the process it was discovered by has
+// exited and its pid was reused, so the inode of the netns opened is checked.
+// On a mismatch, the netns is opened via any other process in it and the netns
+// are rediscovered on the next scrape.
+func (e *exporter) openNetns(t target) (netns.NsHandle, error) {
+	handle, err := netns.GetFromPath(t.path)
+	if t.inode == 0 {
+		if err != nil {
+			return handle, fmt.Errorf("failed to open fd of target netns %q: %w", t.path, err)
+		}
+
+		return handle, nil
+	}
+
+	if err == nil {
+		if handleInode(handle) == t.inode {
+			return handle, nil
+		}
+
+		_ = handle.Close()
+	}
+
+	e.expireDiscovery()
+
+	path := findProcNetns(_procDir, t.inode)
+	if path == "" {
+		return netns.None(), fmt.Errorf("netns %q is gone", t.name)
+	}
+
+	handle, err = netns.GetFromPath(path)
+	if err != nil {
+		return handle, fmt.Errorf("failed to open fd of target netns %q: %w", path, err)
+	}
+
+	if handleInode(handle) != t.inode {
+		_ = handle.Close()
+
+		return netns.None(), fmt.Errorf("netns %q is gone", t.name)
+	}
+
+	return handle, nil
+}
+
+// handleInode returns the inode of the netns of handle, or 0 if it can't be
+// determined.
+func handleInode(handle netns.NsHandle) uint64 {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(handle), &stat); err != nil {
+		return 0
+	}
+
+	return stat.Ino
+}
+
+func (e *exporter) execInNetns(t target, fn func()) (err error) {
+	if t.err != nil {
+		return e.scrapeErrors.Count(t.name, internal.OpNetnsPrepare, t.err)
+	}
+
+	if t.path == "" {
 		fn()
 
 		return nil
 	}
 
 	var (
+		name       = t.name
 		targetNs   netns.NsHandle
 		originalNs netns.NsHandle
 	)
 
-	targetNs, err = netns.GetFromName(name)
+	targetNs, err = e.openNetns(t)
 	if err != nil {
-		return e.scrapeErrors.Count(
-			name,
-			internal.OpNetnsPrepare,
-			fmt.Errorf("failed to open fd of target netns %q: %w", name, err),
-		)
+		return e.scrapeErrors.Count(name, internal.OpNetnsPrepare, err)
 	}
 
 	defer func() {
@@ -82,10 +248,12 @@ func (e *exporter) execInNetns(name string, fn func()) (err error) {
 				if err == nil || errors.As(err, &errNs) && errRestore.OpPriority(errNs) {
 					err = errRestore
 				}
+			} else {
+				// If the thread is stuck in the target netns, it stays locked,
+				// so the Go runtime terminates it once the goroutine exits.
+				runtime.UnlockOSThread()
 			}
 
-			runtime.UnlockOSThread()
-
 			if errClose := originalNs.Close(); errClose != nil {
 				errCleanup := e.scrapeErrors.Count(
 					name,
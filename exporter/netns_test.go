@@ -0,0 +1,94 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestNetnsSpecs(t *testing.T) {
+	t.Parallel()
+
+	name := fmt.Sprintf("conntrack-stats-exporter-test-spec-%d", os.Getpid())
+
+	newNamedNetns(t, name)
+
+	body := scrape(t, exporter.Handler(
+		exporter.WithSource(fakeSource{stats: exporter.Stats{Count: 42}}),
+		exporter.WithNetNs([]string{
+			"",
+			name,
+			"foo=name:" + name,
+			"path:/run/netns/" + name,
+			fmt.Sprintf("self=pid:%d", os.Getpid()),
+			"relative=path:run/netns/" + name,
+			"pid:kaputt",
+		}),
+	))
+
+	for _, want := range []string{
+		`conntrack_stats_count{netns=""} 42`,
+		`conntrack_stats_count{netns="` + name + `"} 42`,
+		`conntrack_stats_count{netns="foo"} 42`,
+		`conntrack_stats_count{netns="path:/run/netns/` + name + `"} 42`,
+		`conntrack_stats_count{netns="self"} 42`,
+		`conntrack_stats_scrape_error{netns="relative",cause="netns_prepare"} 1`,
+		`conntrack_stats_scrape_error{netns="pid:kaputt",cause="netns_prepare"} 1`,
+	} {
+		if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+			t.Errorf("expected to find %s, but didn't", want)
+		}
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+func TestCheckNetNs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		netnsList []string
+		valid     bool
+	}{
+		{[]string{""}, true},
+		{[]string{"", "foo", "bar=name:foo", "path:/run/netns/foo", "pid:1", "a=pid:1"}, true},
+		{[]string{"foo", "foo=pid:1"}, false},
+		{[]string{"foo", "name:foo"}, false},
+		{[]string{"=pid:1"}, false},
+		{[]string{"name:"}, false},
+		{[]string{"name:foo/bar"}, false},
+		{[]string{"path:foo"}, false},
+		{[]string{"pid:-1"}, false},
+		{[]string{"pid:foo"}, false},
+	} {
+		err := exporter.CheckNetNs(tc.netnsList)
+		if tc.valid && err != nil {
+			t.Errorf("expected %q to be valid, got %v", tc.netnsList, err)
+		}
+
+		if !tc.valid && err == nil {
+			t.Errorf("expected %q to be invalid, but wasn't", tc.netnsList)
+		}
+	}
+}
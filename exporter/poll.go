@@ -0,0 +1,83 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// WithPolling makes the exporter gather the metrics in the background once per
+// interval instead of on every scrape.  Scrapes are served from the last
+// snapshot along with its age; until the first snapshot is done, they are
+// gathered as usual.  Polling stops when ctx is done.
+func WithPolling(ctx context.Context, interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pollCtx = ctx
+		cfg.pollInterval = interval
+	}
+}
+
+// snapshot are the metrics gathered in the background.  The metrics must not
+// be modified once stored.
+type snapshot struct {
+	metrics internal.Metrics
+	time    time.Time
+}
+
+func (e *exporter) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// The ticker may be due as well when polling is stopped.
+		if ctx.Err() != nil {
+			return
+		}
+
+		metrics := e.collect(ctx)
+
+		e.snapshot.Store(&snapshot{metrics: metrics, time: time.Now()})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshotMetrics returns the metrics of the last snapshot including its age.
+// It reports false if there is no snapshot.
+func (e *exporter) snapshotMetrics() (internal.Metrics, bool) {
+	snap := e.snapshot.Load()
+	if snap == nil {
+		return internal.Metrics{}, false
+	}
+
+	metrics := snap.metrics.Clone()
+
+	metrics.GetOrInit(e.cfg.prefix, "gauge", "snapshot_age_seconds").AddSample(
+		nil,
+		strconv.FormatFloat(time.Since(snap.time).Seconds(), 'f', 3, 64),
+	)
+
+	return metrics, true
+}
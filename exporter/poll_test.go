@@ -0,0 +1,77 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+// countingSource counts how often it has been asked for stats.
+type countingSource struct{ calls atomic.Int64 }
+
+func (c *countingSource) Stats(context.Context, string) (exporter.Stats, error) {
+	return exporter.Stats{Count: uint64(c.calls.Add(1))}, nil //nolint:gosec
+}
+
+func TestPolling(t *testing.T) {
+	var (
+		src     = new(countingSource)
+		handler = exporter.Handler(exporter.WithSource(src), exporter.WithPolling(t.Context(), time.Hour))
+	)
+
+	snapshotAge := regexp.MustCompile(`(?m)^conntrack_stats_snapshot_age_seconds \d+\.\d+$`)
+
+	// Until the first snapshot is stored, scrapes gather the metrics
+	// themselves.
+	var body []byte
+
+	for !snapshotAge.Match(body) {
+		body = scrape(t, handler)
+	}
+
+	var (
+		calls = src.calls.Load()
+		count = regexp.MustCompile(`(?m)^conntrack_stats_count\{netns=""} \d+$`).Find(body)
+	)
+
+	for range 10 {
+		body = scrape(t, handler)
+	}
+
+	if got := src.calls.Load(); got != calls {
+		t.Errorf("expected scrapes to be served from the snapshot, but the source was called %d more times", got-calls)
+	}
+
+	if !bytes.Contains(body, count) {
+		t.Errorf("expected the count of the snapshot, %s", count)
+	}
+
+	if regex := regexp.MustCompile(`(?m)^# TYPE conntrack_stats_snapshot_age_seconds gauge$`); !regex.Match(body) {
+		t.Errorf("expected response to match %s, but didn't", regex)
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
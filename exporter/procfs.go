@@ -0,0 +1,222 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// _procfsStatPath is the per CPU conntrack statistics table of the netns the
+// calling thread is in.  Note that /proc/net is a link to /proc/self/net, which
+// is resolved against the thread group leader.  Since execInNetns only switches
+// the netns of the current (locked) thread, we must use /proc/thread-self.
+var _procfsStatPath = "/proc/thread-self/net/stat/nf_conntrack"
+
+// _possibleCPUsPath is the list of the possible CPUs.  The procfs table has a
+// row per possible CPU, so the rows are numbered by it.
+var _possibleCPUsPath = "/sys/devices/system/cpu/possible"
+
+// procfsStats is the parsed content of /proc/net/stat/nf_conntrack.  The
+// kernel writes one header row with the column names followed by one row of
+// hex-encoded values per (possible) CPU.
+type procfsStats struct {
+	header []string
+	rows   [][]uint64
+}
+
+// ProcfsSource returns a Source that reads the procfs file
+// /proc/net/stat/nf_conntrack, so the conntrack tool is not needed.
+func ProcfsSource() Source { return procfsSource{} }
+
+type procfsSource struct{}
+
+func (procfsSource) ops() []internal.Op {
+	return []internal.Op{internal.OpProcfsRead, internal.OpProcfsParse}
+}
+
+func (procfsSource) Stats(_ context.Context, _ string) (Stats, error) {
+	content, err := os.ReadFile(_procfsStatPath)
+	if err != nil {
+		return Stats{}, &opError{
+			op:  internal.OpProcfsRead,
+			err: fmt.Errorf("failed to read conntrack stats from procfs: %w", err),
+		}
+	}
+
+	table, err := parseProcfsStats(content)
+	if err != nil {
+		return Stats{}, &opError{op: internal.OpProcfsParse, err: err}
+	}
+
+	stats := Stats{CPUs: make([]CPUStats, 0, len(table.rows))}
+
+	// If the possible CPUs are unknown, the rows are numbered by their
+	// index, which is right unless the possible CPUs have gaps.
+	cpus, err := possibleCPUs()
+	if err != nil || len(cpus) != len(table.rows) {
+		cpus = nil
+	}
+
+	for i, row := range table.rows {
+		cpu := i
+		if cpus != nil {
+			cpu = cpus[i]
+		}
+
+		cpuStats := CPUStats{
+			CPU:      cpu,
+			Counters: make(map[string]uint64, len(table.header)),
+		}
+
+		for i, column := range table.header {
+			metricShortName := procfsMetricShortName(column)
+
+			// The entries column is not a per CPU value, but the global
+			// number of entries repeated on every row.
+			if metricShortName == "count" {
+				stats.Count = row[i]
+
+				continue
+			}
+
+			cpuStats.Counters[metricShortName] = row[i]
+		}
+
+		stats.CPUs = append(stats.CPUs, cpuStats)
+	}
+
+	return stats, nil
+}
+
+func parseProcfsStats(content []byte) (procfsStats, error) {
+	var (
+		stats   procfsStats
+		scanner = bufio.NewScanner(bytes.NewReader(content))
+	)
+
+	if !scanner.Scan() {
+		return stats, errors.New("missing header row")
+	}
+
+	for _, column := range bytes.Fields(scanner.Bytes()) {
+		stats.header = append(stats.header, string(column))
+	}
+
+	for scanner.Scan() {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != len(stats.header) {
+			return stats, fmt.Errorf(
+				"row %d has %d columns, but header has %d",
+				len(stats.rows), len(fields), len(stats.header),
+			)
+		}
+
+		row := make([]uint64, len(fields))
+
+		for i, field := range fields {
+			value, err := strconv.ParseUint(string(field), 16, 64)
+			if err != nil {
+				return stats, fmt.Errorf("column %q of row %d: %w", stats.header[i], len(stats.rows), err)
+			}
+
+			row[i] = value
+		}
+
+		stats.rows = append(stats.rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	if len(stats.rows) == 0 {
+		return stats, errors.New("no CPU rows")
+	}
+
+	return stats, nil
+}
+
+// possibleCPUs returns the possible CPUs in ascending order.
+func possibleCPUs() ([]int, error) {
+	content, err := os.ReadFile(_possibleCPUsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCPUList(strings.TrimSpace(string(content)))
+}
+
+// parseCPUList parses a list of CPUs like 0-3,8,10-11 as of cpuset(7).
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+
+	for item := range strings.SplitSeq(list, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q: %w", list, err)
+		}
+
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid CPU list %q: %w", list, err)
+			}
+		}
+
+		if from < 0 || to < from || (len(cpus) > 0 && from <= cpus[len(cpus)-1]) {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// procfsMetricShortName maps a column name of the procfs table to the metric
+// short name, so the metrics are named the same as with the conntrack tool.
+func procfsMetricShortName(column string) string {
+	switch column {
+	case "entries":
+		return "count"
+	case "icmp_error":
+		return "error"
+	case "clashres":
+		return "clash_resolve"
+	case "chainlength":
+		return "chaintoolong"
+	default:
+		return column
+	}
+}
@@ -0,0 +1,187 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestProcfs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		table string
+		want  []string
+	}{
+		{
+			name: "recent kernel",
+			table: "" +
+				"entries  clashres found new invalid ignore delete chainlength insert insert_failed drop early_drop " +
+				"icmp_error  expect_new expect_create expect_delete search_restart\n" +
+				"000001b2  00000001 0000000d 00000000 00002bfa 00000000 00000000 00000000 00000001 00000002 " +
+				"00000003 00000004 00000005  00000000 00000000 00000000 00012af3\n" +
+				"000001b2  00000000 00000006 00000000 0000283a 00000000 00000000 00000000 00000006 00000007 " +
+				"00000008 00000009 0000000a  00000000 00000000 00000000 0000fc41\n",
+			want: []string{
+				`conntrack_stats_count{netns=""} 434`,
+				`conntrack_stats_clash_resolve{cpu="0",netns=""} 1`,
+				`conntrack_stats_found{cpu="0",netns=""} 13`,
+				`conntrack_stats_found{cpu="1",netns=""} 6`,
+				`conntrack_stats_invalid{cpu="1",netns=""} 10298`,
+				`conntrack_stats_insert_failed{cpu="1",netns=""} 7`,
+				`conntrack_stats_error{cpu="0",netns=""} 5`,
+				`conntrack_stats_expect_new{cpu="1",netns=""} 0`,
+				`conntrack_stats_search_restart{cpu="0",netns=""} 76531`,
+			},
+		},
+		{
+			name: "older kernel",
+			table: "" +
+				"entries  searched found new invalid ignore delete delete_list insert insert_failed drop early_drop " +
+				"icmp_error  expect_new expect_create expect_delete search_restart\n" +
+				"0000000a  0000002a 00000001 00000002 00000003 00000004 00000005 00000006 00000007 00000008 " +
+				"00000009 0000000a 0000000b  0000000c 0000000d 0000000e 0000000f\n",
+			want: []string{
+				`conntrack_stats_count{netns=""} 10`,
+				`conntrack_stats_searched{cpu="0",netns=""} 42`,
+				`conntrack_stats_delete_list{cpu="0",netns=""} 6`,
+				`conntrack_stats_drop{cpu="0",netns=""} 9`,
+				`conntrack_stats_expect_delete{cpu="0",netns=""} 14`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "nf_conntrack")
+			if err := os.WriteFile(path, []byte(tc.table), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			exporter.SetProcfsStatPath(t, path)
+			exporter.SetPossibleCPUsPath(t, filepath.Join(t.TempDir(), "missing"))
+
+			body := scrape(t, exporter.Handler(exporter.WithProcfs()))
+
+			for _, want := range tc.want {
+				if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+					t.Errorf("expected to find %s, but didn't", want)
+				}
+			}
+
+			if regexp.MustCompile(`(?m)^conntrack_stats_(entries|icmp_error)`).Match(body) {
+				t.Error("expected procfs column names to be mapped to metric short names")
+			}
+
+			if t.Failed() {
+				t.Logf("response:\n%s", string(body))
+			}
+		})
+	}
+}
+
+func TestProcfsPossibleCPUs(t *testing.T) {
+	const table = "entries found\n00000001 00000001\n00000001 00000002\n00000001 00000003\n"
+
+	for _, tc := range []struct {
+		name     string
+		possible string
+		want     []string
+	}{
+		{"gaps", "0,2-3\n", []string{"0", "2", "3"}},
+		{"no gaps", "0-2\n", []string{"0", "1", "2"}},
+		{"more possible CPUs than rows", "0-3\n", []string{"0", "1", "2"}},
+		{"invalid list", "0,x\n", []string{"0", "1", "2"}},
+		{"unordered list", "2,0-1\n", []string{"0", "1", "2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			if err := os.WriteFile(filepath.Join(dir, "nf_conntrack"), []byte(table), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "possible"), []byte(tc.possible), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			exporter.SetProcfsStatPath(t, filepath.Join(dir, "nf_conntrack"))
+			exporter.SetPossibleCPUsPath(t, filepath.Join(dir, "possible"))
+
+			body := scrape(t, exporter.Handler(exporter.WithProcfs()))
+
+			for i, cpu := range tc.want {
+				want := fmt.Sprintf(`conntrack_stats_found{cpu="%s",netns=""} %d`, cpu, i+1)
+
+				if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+					t.Errorf("expected to find %s, but didn't", want)
+				}
+			}
+
+			if t.Failed() {
+				t.Logf("response:\n%s", string(body))
+			}
+		})
+	}
+}
+
+func TestProcfsBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nf_conntrack")
+	if err := os.WriteFile(path, []byte("entries found\n00000001 kaputt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter.SetProcfsStatPath(t, path)
+
+	body := scrape(t, exporter.Handler(exporter.WithProcfs()))
+
+	regex := regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{.*?cause="procfs_parse".*?} 1$`)
+	if !regex.Match(body) {
+		t.Errorf("expected to find scrape error with cause \"procfs_parse\", but didn't")
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+func scrape(t *testing.T, handler http.Handler) []byte {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody))
+
+	resp := recorder.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
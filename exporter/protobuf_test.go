@@ -0,0 +1,257 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+func TestProtobufFormat(t *testing.T) {
+	_, body := scrapeAccept(
+		t,
+		exporter.Handler(exporter.WithSource(fakeSource{stats: testStats})),
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+	)
+
+	families := make(map[string]pbFamily)
+
+	for len(body) > 0 {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < size {
+			t.Fatalf("invalid length of message")
+		}
+
+		family := decodeFamily(t, body[n:n+int(size)])
+		families[family.name] = family
+
+		body = body[n+int(size):]
+	}
+
+	for _, want := range []struct {
+		family string
+		typ    uint64
+		labels string
+		value  float64
+	}{
+		{"conntrack_stats_drop", 0, "cpu=0,netns=", 4},
+		{"conntrack_stats_insert_failed", 0, "cpu=1,netns=", 23},
+		{"conntrack_stats_count", 1, "netns=", 42},
+		{"conntrack_stats_scrape_error", 0, "netns=,cause=source", 0},
+	} {
+		family, ok := families[want.family]
+		if !ok {
+			t.Errorf("expected to find metric family %s, but didn't", want.family)
+
+			continue
+		}
+
+		if family.typ != want.typ {
+			t.Errorf("expected %s to be of type %d, got %d", want.family, want.typ, family.typ)
+		}
+
+		if family.help == "" {
+			t.Errorf("expected %s to have a help text", want.family)
+		}
+
+		metric, ok := family.metrics[want.labels]
+		if !ok {
+			t.Errorf("expected to find %s{%s}, but didn't", want.family, want.labels)
+
+			continue
+		}
+
+		if metric.value != want.value {
+			t.Errorf("expected %s{%s} to be %v, got %v", want.family, want.labels, want.value, metric.value)
+		}
+	}
+
+	if created := families["conntrack_stats_scrape_error"].metrics["netns=,cause=source"].created; created <= 0 {
+		t.Errorf("expected scrape error counters to have a created timestamp, got %d", created)
+	}
+}
+
+type pbFamily struct {
+	name    string
+	help    string
+	typ     uint64
+	metrics map[string]pbMetric
+}
+
+// writeRecorder records the writes.
+type writeRecorder struct{ writes [][]byte }
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), p...))
+
+	return len(p), nil
+}
+
+func TestProtobufStreamedSkippingBadSamples(t *testing.T) {
+	metrics := internal.NewMetrics(false, nil, nil)
+
+	count := metrics.GetOrInit("p", "gauge", "count")
+	count.AddSample(internal.Labels{{Key: "netns", Value: "a"}}, "1")
+	count.AddSample(internal.Labels{{Key: "netns", Value: "b"}}, "kaputt")
+	count.AddSample(internal.Labels{{Key: "netns", Value: "c"}}, "3")
+	metrics.GetOrInit("p", "gauge", "max").AddSample(nil, "4")
+
+	var w writeRecorder
+
+	if _, err := metrics.WriteProtobufTo(&w); err == nil {
+		t.Error("expected the error of the bad sample, got none")
+	}
+
+	if len(w.writes) != 2 {
+		t.Fatalf("expected a write per family, got %d writes", len(w.writes))
+	}
+
+	size, n := binary.Uvarint(w.writes[0])
+	if n <= 0 || uint64(len(w.writes[0])-n) != size {
+		t.Fatal("invalid length of message")
+	}
+
+	family := decodeFamily(t, w.writes[0][n:])
+
+	if family.name != "p_count" || len(family.metrics) != 2 ||
+		family.metrics["netns=a"].value != 1 || family.metrics["netns=c"].value != 3 {
+		t.Errorf("expected p_count with the samples a and c only, got %+v", family)
+	}
+}
+
+type pbMetric struct {
+	value   float64
+	created int64
+}
+
+// pbField is a field of a protobuf message.
+type pbField struct {
+	num   uint64
+	value uint64
+	bytes []byte
+}
+
+func decodeFields(t *testing.T, b []byte) []pbField {
+	t.Helper()
+
+	var fields []pbField
+
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("invalid tag")
+		}
+
+		b = b[n:]
+		field := pbField{num: tag >> 3}
+
+		switch tag & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("invalid varint")
+			}
+
+			b = b[n:]
+		case 1:
+			field.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				t.Fatal("invalid length")
+			}
+
+			field.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+func decodeFamily(t *testing.T, b []byte) pbFamily {
+	t.Helper()
+
+	family := pbFamily{metrics: make(map[string]pbMetric)}
+
+	for _, field := range decodeFields(t, b) {
+		switch field.num {
+		case 1:
+			family.name = string(field.bytes)
+		case 2:
+			family.help = string(field.bytes)
+		case 3:
+			family.typ = field.value
+		case 4:
+			labels, metric := decodeMetric(t, field.bytes)
+			family.metrics[labels] = metric
+		}
+	}
+
+	return family
+}
+
+func decodeMetric(t *testing.T, b []byte) (string, pbMetric) {
+	t.Helper()
+
+	var (
+		labels []string
+		metric pbMetric
+	)
+
+	for _, field := range decodeFields(t, b) {
+		switch field.num {
+		case 1:
+			var name, value string
+
+			for _, pair := range decodeFields(t, field.bytes) {
+				if pair.num == 1 {
+					name = string(pair.bytes)
+				} else {
+					value = string(pair.bytes)
+				}
+			}
+
+			labels = append(labels, name+"="+value)
+		case 2, 3:
+			for _, v := range decodeFields(t, field.bytes) {
+				switch v.num {
+				case 1:
+					metric.value = math.Float64frombits(v.value)
+				case 3:
+					for _, ts := range decodeFields(t, v.bytes) {
+						if ts.num == 1 {
+							metric.created = int64(ts.value) //nolint:gosec
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return strings.Join(labels, ","), metric
+}
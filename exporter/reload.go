@@ -0,0 +1,65 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+// Reload replaces the configuration of the exporter by the one of opts, which
+// starts from the defaults just like New.  Scrapes in flight finish with the
+// previous configuration, later ones use the new one.
+//
+// The scrape errors, retained errors and last successes of the netns that
+// remain are carried over, those of netns that are gone are dropped.  Scrapes
+// in flight don't count towards them anymore.  Concurrent reloads take
+// effect one after the other.
+func (x *Exporter) Reload(opts ...Option) {
+	x.reloading.Lock()
+	defer x.reloading.Unlock()
+
+	old := x.e.Load()
+
+	cfg := newConfig(opts...)
+	targets, names := parseTargets(cfg.netnsList)
+
+	// Carry over the discovered netns as well, unless discovery is off now.
+	// Those that are gone are dropped on the next discovery.
+	if cfg.discoverNamed || cfg.discoverProc {
+		old.discovery.mu.Lock()
+
+		for _, t := range old.discovery.targets {
+			names = append(names, t.name)
+		}
+
+		old.discovery.mu.Unlock()
+	}
+
+	e := newExporterWith(cfg, targets, old.scrapeErrors.Successor(names, sourceOps(cfg.source), cfg.errorHistory))
+
+	// The counters of the exporter itself keep counting.
+	e.created = old.created
+	e.coalescing.coalesced.Store(old.coalescing.coalesced.Load())
+
+	old.toolInfo.mu.Lock()
+	e.toolInfo.path, e.toolInfo.modTime, e.toolInfo.version = old.toolInfo.path, old.toolInfo.modTime, old.toolInfo.version
+	old.toolInfo.mu.Unlock()
+
+	e.start()
+
+	x.e.Store(e)
+
+	if old.stopPolling != nil {
+		old.stopPolling()
+	}
+}
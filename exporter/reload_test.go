@@ -0,0 +1,189 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestReloadInFlight(t *testing.T) {
+	src := &blockingSource{release: make(chan struct{})}
+
+	exp := exporter.New(exporter.WithSource(src))
+
+	done := make(chan []byte)
+
+	go func() { done <- scrape(t, exp) }()
+
+	for src.calls.Load() == 0 {
+		runtime.Gosched()
+	}
+
+	exp.Reload(exporter.WithSource(fakeSource{stats: exporter.Stats{Count: 23}}), exporter.WithPrefix("reloaded"))
+
+	close(src.release)
+
+	if body := <-done; !bytes.Contains(body, []byte(`conntrack_stats_count{netns=""} 42`)) {
+		t.Errorf("expected the scrape in flight to finish with the previous configuration, got:\n%s", body)
+	}
+
+	if body := scrape(t, exp); !bytes.Contains(body, []byte(`reloaded_count{netns=""} 23`)) {
+		t.Errorf("expected the next scrape to use the new configuration, got:\n%s", body)
+	}
+}
+
+func TestReloadScrapeErrors(t *testing.T) {
+	src := exporter.WithSource(fakeSource{err: errors.New("kaputt")})
+
+	exp := exporter.New(src, exporter.WithNetNs([]string{"", "gone=pid:0"}))
+
+	scrape(t, exp)
+
+	exp.Reload(src, exporter.WithNetNs([]string{"", "new=pid:0"}))
+
+	body := scrape(t, exp)
+
+	for _, want := range []string{
+		`conntrack_stats_scrape_error{netns="",cause="source"} 2`,
+		`conntrack_stats_scrape_error{netns="new",cause="netns_prepare"} 1`,
+	} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("expected %q in:\n%s", want, body)
+		}
+	}
+
+	if bytes.Contains(body, []byte(`netns="gone"`)) {
+		t.Errorf("expected the netns gone to be dropped, got:\n%s", body)
+	}
+
+	if errs := scrapeErrors(t, exp.ErrorsHandler(), ""); len(errs[""]) != 2 || errs["gone"] != nil {
+		t.Errorf("expected the retained errors of the netns that remain only, got %v", errs)
+	}
+}
+
+func TestReloadScrapeErrorsInFlight(t *testing.T) {
+	src := &blockingSource{release: make(chan struct{})}
+
+	exp := exporter.New(exporter.WithSource(src))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		exp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, http.MethodGet, "/", http.NoBody))
+	}()
+
+	for src.calls.Load() == 0 {
+		runtime.Gosched()
+	}
+
+	exp.Reload(exporter.WithSource(fakeSource{}))
+
+	// The scrape in flight fails after the reload.
+	cancel()
+	<-done
+
+	body := scrape(t, exp)
+
+	if want := []byte(`conntrack_stats_scrape_error{netns="",cause="client_gone"} 0`); !bytes.Contains(body, want) {
+		t.Errorf("expected the scrape in flight not to count after the reload, %s, got:\n%s", want, body)
+	}
+}
+
+// netnsCounter counts the calls per netns.
+type netnsCounter struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *netnsCounter) Stats(_ context.Context, netns string) (exporter.Stats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls[netns]++
+
+	return exporter.Stats{}, nil
+}
+
+func (c *netnsCounter) reset() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := c.calls
+	c.calls = make(map[string]int)
+
+	return calls
+}
+
+func (c *netnsCounter) count(netns string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls[netns]
+}
+
+func TestReloadConcurrently(t *testing.T) {
+	var (
+		src  = &netnsCounter{calls: make(map[string]int)}
+		self = fmt.Sprintf("pid:%d", os.Getpid())
+		opts = func(netns string) []exporter.Option {
+			return []exporter.Option{
+				exporter.WithSource(src),
+				exporter.WithNetNs([]string{netns + "=" + self}),
+				exporter.WithPolling(t.Context(), time.Millisecond),
+			}
+		}
+		exp = exporter.New(opts("initial")...)
+		wg  sync.WaitGroup
+	)
+
+	for i := range 8 {
+		wg.Go(func() { exp.Reload(opts(fmt.Sprintf("concurrent%d", i))...) })
+	}
+
+	wg.Wait()
+
+	exp.Reload(opts("final")...)
+
+	// Every poller but the one of the final configuration is stopped, so
+	// only a collection in flight while reloading may have come in late.
+	src.reset()
+
+	for src.count("final") < 20 {
+		runtime.Gosched()
+	}
+
+	for netns, calls := range src.reset() {
+		if netns != "final" && calls > 1 {
+			t.Errorf("expected the poller of netns %q to be stopped, got %d calls", netns, calls)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// Source is a backend that provides the conntrack statistics of a netns.
+//
+// The exporter calls Stats with the calling goroutine locked to an OS thread
+// that has already entered the netns, so an implementation that reads the
+// statistics from the kernel sees the conntrack table of that netns.  The netns
+// argument is the name of the netns, the empty string being the netns of the
+// exporter itself; implementations usually only need it for logging.
+//
+// Implementations must be safe for concurrent use.
+type Source interface {
+	Stats(ctx context.Context, netns string) (Stats, error)
+}
+
+// Stats are the conntrack statistics of a netns.
+type Stats struct {
+	// CPUs are the per CPU statistics.
+	CPUs []CPUStats
+
+	// Count is the number of entries in the conntrack table.
+	Count uint64
+}
+
+// CPUStats are the conntrack statistics of a single CPU.
+type CPUStats struct {
+	CPU int
+
+	// Counters maps metric short names, e.g. "insert_failed", to the values
+	// of the counters.  Names are expected to follow the names the conntrack
+	// tool prints.
+	Counters map[string]uint64
+}
+
+// WithSource sets the backend the exporter reads the conntrack statistics
+// from.  The default is ToolSource.
+func WithSource(src Source) Option { return func(cfg *config) { cfg.source = src } }
+
+// opError attributes an error of a built-in Source to the cause it is counted
+// as in the scrape_error metric.  Errors of other sources are counted as
+// internal.OpSource.
+type opError struct {
+	op  internal.Op
+	err error
+}
+
+func (e *opError) Error() string { return fmt.Sprintf("%s: %v", e.op, e.err) }
+func (e *opError) Unwrap() error { return e.err }
+
+// sourceOps returns the causes of scrape errors a source may produce, so the
+// scrape_error counters can be initialized.
+func sourceOps(src Source) []internal.Op {
+	if s, ok := src.(interface{ ops() []internal.Op }); ok {
+		return s.ops()
+	}
+
+	return []internal.Op{internal.OpSource}
+}
@@ -0,0 +1,84 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+type fakeSource struct {
+	stats exporter.Stats
+	err   error
+}
+
+func (f fakeSource) Stats(context.Context, string) (exporter.Stats, error) { return f.stats, f.err }
+
+func TestSource(t *testing.T) {
+	src := fakeSource{
+		stats: exporter.Stats{
+			CPUs: []exporter.CPUStats{
+				{CPU: 0, Counters: map[string]uint64{"insert_failed": 17, "drop": 4}},
+				{CPU: 1, Counters: map[string]uint64{"insert_failed": 23, "drop": 0}},
+			},
+			Count: 42,
+		},
+	}
+
+	body := scrape(t, exporter.Handler(exporter.WithSource(src)))
+
+	for _, want := range []string{
+		`conntrack_stats_count{netns=""} 42`,
+		`conntrack_stats_insert_failed{cpu="0",netns=""} 17`,
+		`conntrack_stats_insert_failed{cpu="1",netns=""} 23`,
+		`conntrack_stats_drop{cpu="0",netns=""} 4`,
+		`conntrack_stats_drop{cpu="1",netns=""} 0`,
+		`conntrack_stats_scrape_error{netns="",cause="source"} 0`,
+	} {
+		if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+			t.Errorf("expected to find %s, but didn't", want)
+		}
+	}
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{.*?cause="tool_exec"`).Match(body) {
+		t.Error("expected no scrape error counters of the conntrack tool source")
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	body := scrape(t, exporter.Handler(exporter.WithSource(fakeSource{err: errors.New("kaputt")})))
+
+	if !regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{netns="",cause="source"} 1$`).Match(body) {
+		t.Errorf("expected to find scrape error with cause \"source\", but didn't")
+	}
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_count`).Match(body) {
+		t.Errorf("expected no count metric of a failed source")
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
@@ -0,0 +1,76 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// _sysctlDir is the directory of the net.netfilter sysctls.  The kernel
+// resolves the net sysctls against the netns of the calling thread, so this
+// works within execInNetns.
+var _sysctlDir = "/proc/sys/net/netfilter"
+
+// _sysctls maps metric short names to the sysctls describing the limits of the
+// conntrack table.
+var _sysctls = []struct {
+	metricShortName string
+	name            string
+}{
+	{"max", "nf_conntrack_max"},
+	{"buckets", "nf_conntrack_buckets"},
+	{"expect_max", "nf_conntrack_expect_max"},
+}
+
+// readSysctls reads the conntrack table limits of the netns of the calling
+// thread.  Sysctls that don't exist are left out, e.g. nf_conntrack_buckets
+// on kernels that don't expose it to child netns.
+func readSysctls() (map[string]uint64, error) {
+	var (
+		values = make(map[string]uint64, len(_sysctls))
+		errs   []error
+	)
+
+	for _, sysctl := range _sysctls {
+		content, err := os.ReadFile(filepath.Join(_sysctlDir, sysctl.name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		value, err := strconv.ParseUint(string(bytes.TrimSpace(content)), 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value of sysctl %s: %w", sysctl.name, err))
+
+			continue
+		}
+
+		values[sysctl.metricShortName] = value
+	}
+
+	return values, errors.Join(errs...)
+}
@@ -0,0 +1,64 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+func TestSysctls(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, value := range map[string]string{
+		"nf_conntrack_max":        "100\n",
+		"nf_conntrack_buckets":    "64\n",
+		"nf_conntrack_expect_max": "kaputt\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exporter.SetSysctlDir(t, dir)
+
+	body := scrape(t, exporter.Handler(exporter.WithSource(fakeSource{stats: exporter.Stats{Count: 42}})))
+
+	for _, want := range []string{
+		`conntrack_stats_count{netns=""} 42`,
+		`conntrack_stats_max{netns=""} 100`,
+		`conntrack_stats_buckets{netns=""} 64`,
+		`conntrack_stats_fill_ratio{netns=""} 0.42`,
+		`conntrack_stats_scrape_error{netns="",cause="sysctl_read"} 1`,
+	} {
+		if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(want) + `$`).Match(body) {
+			t.Errorf("expected to find %s, but didn't", want)
+		}
+	}
+
+	if regexp.MustCompile(`(?m)^conntrack_stats_expect_max`).Match(body) {
+		t.Error("expected no expect_max metric for an invalid sysctl value")
+	}
+
+	if t.Failed() {
+		t.Logf("response:\n%s", string(body))
+	}
+}
@@ -0,0 +1,221 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+// ToolSource returns a Source that executes the conntrack tool of
+// conntrack-tools, which must be in $PATH.
+func ToolSource() Source { return toolSource{} }
+
+type toolSource struct {
+	// logger logs every execution at level debug.
+	logger *slog.Logger
+}
+
+func (s toolSource) withLogger(logger *slog.Logger) Source {
+	s.logger = logger
+
+	return s
+}
+
+func (toolSource) ops() []internal.Op {
+	return []internal.Op{
+		internal.OpExecTool,
+		internal.OpToolOutputNoMatch,
+		internal.OpToolPermissionDenied,
+		internal.OpToolModuleNotLoaded,
+		internal.OpToolUnsupportedOption,
+	}
+}
+
+func (s toolSource) Stats(ctx context.Context, netns string) (Stats, error) {
+	logger := s.logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+
+	logger = logger.With(slog.String("netns", netns))
+
+	statsOutput, err := getConntrackStats(ctx, logger)
+	if err != nil {
+		return Stats{}, &opError{op: classifyToolError(err), err: fmt.Errorf("failed to exec conntrack tool: %w", err)}
+	}
+
+	countOutput, err := getConntrackCounter(ctx, logger)
+	if err != nil {
+		return Stats{}, &opError{op: classifyToolError(err), err: fmt.Errorf("failed to exec conntrack tool: %w", err)}
+	}
+
+	cpus, err := parseToolStats(statsOutput)
+	if err != nil {
+		return Stats{}, &opError{op: internal.OpToolOutputNoMatch, err: err}
+	}
+
+	count, err := strconv.ParseUint(countOutput, 10, 64)
+	if err != nil {
+		return Stats{}, &opError{op: internal.OpToolOutputNoMatch, err: fmt.Errorf("invalid count: %w", err)}
+	}
+
+	return Stats{CPUs: cpus, Count: count}, nil
+}
+
+func parseToolStats(statsOutput []byte) ([]CPUStats, error) {
+	matches := _regex.FindAllSubmatch(statsOutput, -1)
+
+	if len(matches) == 0 {
+		return nil, errors.New("output of conntrack --stats did not match")
+	}
+
+	cpus := make([]CPUStats, 0, len(matches))
+
+	for _, match := range matches {
+		cpu := CPUStats{Counters: make(map[string]uint64, len(match))}
+
+		for i, metricShortName := range _regex.SubexpNames() {
+			value := match[i]
+
+			if len(value) == 0 {
+				// skip empty sub-matches
+				continue
+			}
+
+			var err error
+
+			switch metricShortName {
+			case "":
+				// skip full match
+				continue
+			case "cpu":
+				cpu.CPU, err = strconv.Atoi(string(value))
+			default:
+				cpu.Counters[metricShortName], err = strconv.ParseUint(string(value), 10, 64)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %w", metricShortName, err)
+			}
+		}
+
+		cpus = append(cpus, cpu)
+	}
+
+	return cpus, nil
+}
+
+func getConntrackCounter(ctx context.Context, logger *slog.Logger) (string, error) {
+	out, err := runTool(ctx, logger, "--count")
+	if err != nil {
+		return "", fmt.Errorf("error running the conntrack command with the --count flag: %w", err)
+	}
+
+	return string(bytes.TrimSpace(out)), nil
+}
+
+func getConntrackStats(ctx context.Context, logger *slog.Logger) ([]byte, error) {
+	output, err := runTool(ctx, logger, "--stats")
+	if err != nil {
+		return nil, fmt.Errorf("error running the conntrack command with the --stats flag: %w", err)
+	}
+
+	return output, nil
+}
+
+// runTool runs the conntrack tool and returns its stdout.  If it fails, the
+// error is an *internal.ToolError with its stderr and exit code.
+func runTool(ctx context.Context, logger *slog.Logger, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "conntrack", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	logger.DebugContext(
+		ctx,
+		"executed conntrack tool",
+		slog.Any("args", args),
+		slog.Duration("duration", time.Since(start)),
+		slog.Int("exit_code", exitCode),
+	)
+
+	if err != nil {
+		return nil, &internal.ToolError{Args: args, ExitCode: exitCode, Stderr: stderr.String(), Err: err}
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// _toolErrorCauses classify the errors of the conntrack tool by its stderr.
+var _toolErrorCauses = []struct {
+	op      internal.Op
+	pattern *regexp.Regexp
+}{
+	{internal.OpToolPermissionDenied, regexp.MustCompile(`(?i)operation not permitted|permission denied`)},
+	{internal.OpToolModuleNotLoaded, regexp.MustCompile(`(?i)protocol not supported|module .*not loaded|modprobe`)},
+	{internal.OpToolUnsupportedOption, regexp.MustCompile(`(?i)(unknown|invalid|unrecognized|illegal) option`)},
+}
+
+// classifyToolError returns the cause a failed run of the conntrack tool is
+// counted as.
+func classifyToolError(err error) internal.Op {
+	var errTool *internal.ToolError
+	if !errors.As(err, &errTool) {
+		return internal.OpExecTool
+	}
+
+	for _, cause := range _toolErrorCauses {
+		if cause.pattern.MatchString(errTool.Stderr) {
+			return cause.op
+		}
+	}
+
+	return internal.OpExecTool
+}
+
+var _regex = regexp.MustCompile(`` +
+	`(?m)` +
+	`cpu=(?P<cpu>\d+)\s+` +
+	`found=(?P<found>\d+)\s+` +
+	`invalid=(?P<invalid>\d+)\s+` +
+	`(?:ignore=(?P<ignore>\d+)\s+)?` +
+	`insert=(?P<insert>\d+)\s+` +
+	`insert_failed=(?P<insert_failed>\d+)\s+` +
+	`drop=(?P<drop>\d+)\s+` +
+	`early_drop=(?P<early_drop>\d+)\s+` +
+	`error=(?P<error>\d+)\s+` +
+	`search_restart=(?P<search_restart>\d+)`,
+)
@@ -0,0 +1,90 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package exporter_test
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter/internal"
+)
+
+func TestToolErrors(t *testing.T) {
+	for _, tc := range []struct {
+		stderr string
+		cause  internal.Op
+	}{
+		{"kaputt", internal.OpExecTool},
+		{
+			"conntrack v1.4.7 (conntrack-tools): Operation failed: Operation not permitted",
+			internal.OpToolPermissionDenied,
+		},
+		{
+			"conntrack v1.4.7 (conntrack-tools): Operation failed: Protocol not supported",
+			internal.OpToolModuleNotLoaded,
+		},
+		{
+			"conntrack v0.9.14 (conntrack-tools): Unknown option `--stats'",
+			internal.OpToolUnsupportedOption,
+		},
+	} {
+		t.Run(string(tc.cause), func(t *testing.T) {
+			mockConntrackTool(t)
+			t.Setenv("CONNTRACK_STATS_EXPORTER_KAPUTT", "true")
+			t.Setenv("CONNTRACK_STATS_EXPORTER_KAPUTT_MESSAGE", tc.stderr)
+			t.Setenv("CONNTRACK_STATS_EXPORTER_EXIT_CODE", "2")
+
+			var (
+				errorLogBuf = new(bytes.Buffer)
+				exp         = exporter.New(exporter.WithErrorLogger(logger(errorLogBuf)))
+			)
+
+			body := scrape(t, exp)
+
+			regex := regexp.MustCompile(`(?m)^conntrack_stats_scrape_error\{netns="",cause="([a-z_]+)"} 1$`)
+
+			var causes []string
+			for _, match := range regex.FindAllSubmatch(body, -1) {
+				causes = append(causes, string(match[1]))
+			}
+
+			if len(causes) != 1 || causes[0] != string(tc.cause) {
+				t.Errorf("expected one scrape error with cause %s, got %v", tc.cause, causes)
+			}
+
+			errs := scrapeErrors(t, exp.ErrorsHandler(), "")[""]
+			if len(errs) != 1 {
+				t.Fatalf("expected one retained error, got %d", len(errs))
+			}
+
+			if got := errs[0]; got.Op != string(tc.cause) || got.Stderr != tc.stderr+"\n" || got.ExitCode != 2 {
+				t.Errorf("expected error with cause %s, stderr %q and exit code 2, got %+v", tc.cause, tc.stderr, got)
+			}
+
+			if got := errs[0].Message; got == "" || strings.Contains(got, tc.stderr) {
+				t.Errorf("expected the message without the stderr, got %q", got)
+			}
+
+			if !strings.Contains(errorLogBuf.String(), tc.stderr) {
+				t.Errorf("expected the log to contain the stderr of the tool, got %q", errorLogBuf.String())
+			}
+		})
+	}
+}
@@ -1,7 +1,11 @@
 module github.com/jwkohnen/conntrack-stats-exporter
 
-go 1.26
+go 1.26.0
 
-require github.com/vishvananda/netns v0.0.5
-
-require golang.org/x/sys v0.46.0 // indirect
+require (
+	github.com/klauspost/compress v1.20.1
+	github.com/vishvananda/netns v0.0.5
+	go.yaml.in/yaml/v3 v3.0.5
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+)
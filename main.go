@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -46,15 +47,36 @@ func main() {
 		debug.SetGCPercent(10)
 	}
 
-	cfg, opts := configure()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg, opts := configure(ctx)
 
 	const procPath = "/proc/net/stat/nf_conntrack"
-	if !cfg.quiet && checkProc(procPath) {
-		cfg.logf("HINT: the file %q is available, you may use prometheus/node_exporter instead.", procPath)
+	if !cfg.quiet && cfg.source == "conntrack" && checkProc(procPath) {
+		cfg.logger.Info(
+			"HINT: the file is available, you may use -source=procfs or prometheus/node_exporter instead",
+			slog.String("file", procPath),
+		)
 	}
 
+	exp := exporter.New(opts...)
+
 	mux := http.NewServeMux()
-	mux.Handle(cfg.path, newAbortHandler(exporter.Handler(opts...)))
+	mux.Handle(cfg.path, newAbortHandler(exp))
+
+	if cfg.errorsPath != "" {
+		mux.Handle(cfg.errorsPath, newAbortHandler(exp.ErrorsHandler()))
+	}
+
+	if cfg.configFile != "" {
+		r := &reloader{ctx: ctx, exp: exp, args: os.Args[1:], lookupEnv: os.LookupEnv, started: cfg}
+
+		if cfg.enableLifecycle {
+			mux.Handle("/-/reload", newAbortHandler(r))
+		}
+
+		go r.reloadOnSignal()
+	}
 
 	srv := &http.Server{
 		Addr:         cfg.addr,
@@ -63,6 +85,18 @@ func main() {
 		WriteTimeout: cfg.timeoutHTTP,
 	}
 
+	if cfg.webConfigFile != "" {
+		web, err := newWebServer(cfg.webConfigFile, cfg.logger)
+		if err != nil {
+			abort(err)
+		}
+
+		go web.watch(ctx, webCheckInterval)
+
+		srv.Handler = web.handler(mux)
+		srv.TLSConfig = web.tlsConfig()
+	}
+
 	shutdown := make(chan os.Signal, 1)
 
 	var (
@@ -79,6 +113,9 @@ func main() {
 
 		signal.Stop(shutdown)
 
+		// stop background polling, if any
+		cancel()
+
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.timeoutShutdown)
 		defer cancel()
 
@@ -87,9 +124,20 @@ func main() {
 		}
 	})
 
-	cfg.logf("listening on %s with endpoint %q\n", cfg.addr, cfg.path)
+	cfg.logger.Info(
+		"listening",
+		slog.String("addr", cfg.addr),
+		slog.String("path", cfg.path),
+		slog.Bool("tls", srv.TLSConfig != nil),
+	)
+
+	var err error
 
-	err := srv.ListenAndServe()
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 
 	wg.Wait()
 
@@ -0,0 +1,118 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/jwkohnen/conntrack-stats-exporter/exporter"
+)
+
+// reloader reloads the configuration file on SIGHUP or on POST requests.  The
+// settings of the HTTP server take effect only on restart.
+type reloader struct {
+	ctx context.Context //nolint:containedctx
+	exp *exporter.Exporter
+
+	// args and lookupEnv are passed to load.
+	args      []string
+	lookupEnv func(string) (string, bool)
+
+	// started is the configuration the process started with.
+	started config
+
+	mu sync.Mutex
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := load(r.args, r.lookupEnv)
+	if err != nil {
+		return err
+	}
+
+	c.logger = r.started.logger
+
+	opts, err := c.options(r.ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"addr", c.addr != r.started.addr},
+		{"path", c.path != r.started.path},
+		{"timeout-http", c.timeoutHTTP != r.started.timeoutHTTP},
+		{"timeout-shutdown", c.timeoutShutdown != r.started.timeoutShutdown},
+	} {
+		if setting.changed {
+			c.logger.Warn("setting changed, restart to apply", slog.String("setting", setting.name))
+		}
+	}
+
+	r.exp.Reload(opts...)
+
+	c.logger.Info("reloaded configuration", slog.String("file", c.configFile))
+
+	return nil
+}
+
+// ServeHTTP reloads the configuration on POST requests.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		r.started.logger.ErrorContext(req.Context(), "error reloading configuration", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// reloadOnSignal reloads the configuration on SIGHUP until the context is done.
+func (r *reloader) reloadOnSignal() {
+	hangup := make(chan os.Signal, 1)
+
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-hangup:
+			if err := r.reload(); err != nil {
+				r.started.logger.Error("error reloading configuration", slog.Any("error", err))
+			}
+		}
+	}
+}
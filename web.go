@@ -0,0 +1,536 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// webConfig is the web configuration file in the format of the Prometheus
+// exporter-toolkit, see
+// https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md.
+// Only the settings below are supported.  The other settings of the format,
+// see _unsupportedKeys, are ignored with a warning; unknown settings, e.g.
+// misspelled ones, are an error, so a typo doesn't disable TLS or basic auth.
+type webConfig struct {
+	TLSServerConfig *tlsServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+type tlsServerConfig struct {
+	CertFile          string        `yaml:"cert_file"`
+	KeyFile           string        `yaml:"key_file"`
+	ClientAuthType    string        `yaml:"client_auth_type"`
+	ClientCAFile      string        `yaml:"client_ca_file"`
+	ClientAllowedSANs []string      `yaml:"client_allowed_sans"`
+	MinVersion        tlsVersion    `yaml:"min_version"`
+	MaxVersion        tlsVersion    `yaml:"max_version"`
+	CipherSuites      []cipherSuite `yaml:"cipher_suites"`
+}
+
+// _unsupportedKeys are the settings of the exporter-toolkit format that are
+// not supported, by the path of their parent.  prefer_server_cipher_suites has
+// no effect since Go 1.18.
+var _unsupportedKeys = map[string][]string{
+	"":                   {"http_server_config", "rate_limit"},
+	"tls_server_config.": {"cert", "key", "client_ca", "curve_preferences", "prefer_server_cipher_suites"},
+}
+
+// web is a loaded web configuration file.
+type web struct {
+	// tls is nil if the file has no tls_server_config.
+	tls *tls.Config
+
+	// users are the bcrypt hashes of the passwords by user.
+	users map[string][]byte
+
+	// authenticated caches the successful logins, since bcrypt is slow by
+	// design.  The key is the hash of user, password and bcrypt hash.
+	mu            sync.Mutex
+	authenticated map[[sha256.Size]byte]struct{}
+}
+
+// loadWebConfig loads the web configuration file at path.  Relative paths in
+// the file are relative to the directory of the file.  Unsupported settings
+// are logged.
+func loadWebConfig(path string, logger *slog.Logger) (*web, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var (
+		node yaml.Node
+		cfg  webConfig
+	)
+
+	if err := yaml.NewDecoder(f).Decode(&node); err != nil {
+		return nil, err
+	}
+
+	if err := node.Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	unsupported, err := unsupportedKeys(&node, reflect.TypeFor[webConfig](), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(unsupported) > 0 {
+		logger.Warn(
+			"ignoring unsupported settings of web configuration",
+			slog.String("file", path),
+			slog.String("settings", strings.Join(unsupported, ",")),
+		)
+	}
+
+	w := &web{
+		users:         make(map[string][]byte, len(cfg.BasicAuthUsers)),
+		authenticated: make(map[[sha256.Size]byte]struct{}),
+	}
+
+	for user, hash := range cfg.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash of user %q: %w", user, err)
+		}
+
+		w.users[user] = []byte(hash)
+	}
+
+	if cfg.TLSServerConfig != nil {
+		if w.tls, err = cfg.TLSServerConfig.load(filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("invalid tls_server_config: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+func (c *tlsServerConfig) load(dir string) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(resolvePath(dir, c.CertFile), resolvePath(dir, c.KeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   uint16(c.MinVersion),
+		MaxVersion:   uint16(c.MaxVersion),
+	}
+
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+
+	for _, suite := range c.CipherSuites {
+		cfg.CipherSuites = append(cfg.CipherSuites, uint16(suite))
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(resolvePath(dir, c.ClientCAFile))
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client_ca_file %q", c.ClientCAFile)
+		}
+	}
+
+	switch c.ClientAuthType {
+	case "", "NoClientCert":
+		cfg.ClientAuth = tls.NoClientCert
+	case "RequestClientCert":
+		cfg.ClientAuth = tls.RequestClientCert
+	case "RequireAnyClientCert", "RequireClientCert":
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	case "VerifyClientCertIfGiven":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "RequireAndVerifyClientCert":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client_auth_type %q", c.ClientAuthType)
+	}
+
+	verifies := cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert
+
+	if verifies && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuthType)
+	}
+
+	if !verifies && cfg.ClientCAs != nil {
+		return nil, fmt.Errorf("client_ca_file requires client_auth_type to verify client certificates")
+	}
+
+	if len(c.ClientAllowedSANs) > 0 {
+		if !verifies {
+			return nil, fmt.Errorf("client_allowed_sans requires client_auth_type to verify client certificates")
+		}
+
+		cfg.VerifyPeerCertificate = allowedSANs(c.ClientAllowedSANs)
+	}
+
+	return cfg, nil
+}
+
+// allowedSANs verifies that the client certificate has one of the subject
+// alternative names sans.
+func allowedSANs(sans []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 {
+			// no client certificate with VerifyClientCertIfGiven
+			return nil
+		}
+
+		leaf := chains[0][0]
+		names := slices.Concat(leaf.DNSNames, leaf.EmailAddresses)
+
+		for _, ip := range leaf.IPAddresses {
+			names = append(names, ip.String())
+		}
+
+		for _, uri := range leaf.URIs {
+			names = append(names, uri.String())
+		}
+
+		if slices.ContainsFunc(names, func(name string) bool { return slices.Contains(sans, name) }) {
+			return nil
+		}
+
+		return errors.New("client certificate has none of client_allowed_sans")
+	}
+}
+
+// unsupportedKeys returns the keys of the YAML node that are not fields of
+// the struct type t but known settings, recursively.  Unknown keys are an
+// error.
+func unsupportedKeys(node *yaml.Node, t reflect.Type, prefix string) ([]string, error) {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	fields := make(map[string]reflect.Type, t.NumField())
+
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		fields[name] = t.Field(i).Type
+	}
+
+	var unsupported []string
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+
+		field, ok := fields[key]
+		if !ok {
+			if !slices.Contains(_unsupportedKeys[prefix], key) {
+				return nil, fmt.Errorf("line %d: unknown setting %s", node.Content[i].Line, prefix+key)
+			}
+
+			unsupported = append(unsupported, prefix+key)
+
+			continue
+		}
+
+		nested, err := unsupportedKeys(node.Content[i+1], field, prefix+key+".")
+		if err != nil {
+			return nil, err
+		}
+
+		unsupported = append(unsupported, nested...)
+	}
+
+	return unsupported, nil
+}
+
+// files returns the files of the web configuration, so changes to them can be
+// detected.
+func (c *webConfig) files(dir string) []string {
+	if c.TLSServerConfig == nil {
+		return nil
+	}
+
+	files := []string{resolvePath(dir, c.TLSServerConfig.CertFile), resolvePath(dir, c.TLSServerConfig.KeyFile)}
+
+	if c.TLSServerConfig.ClientCAFile != "" {
+		files = append(files, resolvePath(dir, c.TLSServerConfig.ClientCAFile))
+	}
+
+	return files
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
+
+// authenticate reports whether the password of user is right.
+func (w *web) authenticate(user, password string) bool {
+	hash, ok := w.users[user]
+	if !ok {
+		// Compare with a hash anyway, so unknown users take as long as
+		// known ones.
+		hash = dummyHash()
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+
+	w.mu.Lock()
+	_, cached := w.authenticated[key]
+	w.mu.Unlock()
+
+	if cached {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return false
+	}
+
+	w.mu.Lock()
+
+	if len(w.authenticated) >= maxAuthenticated {
+		clear(w.authenticated)
+	}
+
+	w.authenticated[key] = struct{}{}
+
+	w.mu.Unlock()
+
+	return true
+}
+
+// maxAuthenticated bounds the cache of successful logins.
+const maxAuthenticated = 100
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+	return hash
+})
+
+// webServer serves with the TLS and basic auth settings of a web configuration
+// file, which it loads again whenever watch finds the file or the certificate
+// files referenced by it changed.
+type webServer struct {
+	path   string
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	web   *web
+	stamp string
+}
+
+func newWebServer(path string, logger *slog.Logger) (*webServer, error) {
+	s := &webServer{path: path, logger: logger}
+
+	s.stamp = s.currentStamp()
+
+	var err error
+	if s.web, err = loadWebConfig(path, logger); err != nil {
+		return nil, fmt.Errorf("error loading -web.config.file: %w", err)
+	}
+
+	return s, nil
+}
+
+// webCheckInterval is the interval at which the web configuration file and the
+// certificate files are checked for changes.
+const webCheckInterval = 5 * time.Second
+
+// current returns the web configuration.
+func (s *webServer) current() *web {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.web
+}
+
+// watch reloads the web configuration every interval if the files changed,
+// until ctx is done.
+func (s *webServer) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reload()
+		}
+	}
+}
+
+// reload loads the web configuration again if the files changed.  If the
+// files are invalid, the previous configuration is kept until they change
+// again.
+func (s *webServer) reload() {
+	stamp := s.currentStamp()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stamp == s.stamp {
+		return
+	}
+
+	s.stamp = stamp
+
+	w, err := loadWebConfig(s.path, s.logger)
+	if err == nil && (w.tls == nil) != (s.web.tls == nil) {
+		err = errors.New("enabling or disabling TLS requires a restart")
+	}
+
+	if err != nil {
+		s.logger.Error("error reloading web configuration", slog.String("file", s.path), slog.Any("error", err))
+
+		return
+	}
+
+	s.logger.Info("reloaded web configuration", slog.String("file", s.path))
+
+	s.web = w
+}
+
+// currentStamp returns the modification times and sizes of the web
+// configuration file and the files referenced by it.
+func (s *webServer) currentStamp() string {
+	files := []string{s.path}
+
+	var cfg webConfig
+
+	if content, err := os.ReadFile(s.path); err == nil && yaml.Unmarshal(content, &cfg) == nil {
+		files = append(files, cfg.files(filepath.Dir(s.path))...)
+	}
+
+	var stamp strings.Builder
+
+	for _, file := range files {
+		if stat, err := os.Stat(file); err == nil {
+			_, _ = fmt.Fprintf(&stamp, "%s:%d:%d;", file, stat.ModTime().UnixNano(), stat.Size())
+		}
+	}
+
+	return stamp.String()
+}
+
+// tlsConfig returns the TLS configuration of the server, or nil if the web
+// configuration has no tls_server_config.
+func (s *webServer) tlsConfig() *tls.Config {
+	if s.current().tls == nil {
+		return nil
+	}
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return s.current().tls, nil },
+	}
+}
+
+// handler requires basic auth if the web configuration has users.
+func (s *webServer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		web := s.current()
+
+		if len(web.users) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if ok && web.authenticate(user, password) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// tlsVersion is a TLS version like TLS12.
+type tlsVersion uint16
+
+func (v *tlsVersion) UnmarshalYAML(node *yaml.Node) error {
+	versions := map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+
+	version, ok := versions[node.Value]
+	if !ok {
+		return fmt.Errorf("line %d: unknown TLS version %q", node.Line, node.Value)
+	}
+
+	*v = tlsVersion(version)
+
+	return nil
+}
+
+// cipherSuite is a cipher suite by its name like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+type cipherSuite uint16
+
+func (c *cipherSuite) UnmarshalYAML(node *yaml.Node) error {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == node.Value {
+			*c = cipherSuite(suite.ID)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("line %d: unknown cipher suite %q", node.Line, node.Value)
+}
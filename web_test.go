@@ -0,0 +1,415 @@
+//    This file is part of conntrack-stats-exporter.
+//
+//    conntrack-stats-exporter is free software: you can redistribute it and/or
+//    modify it under the terms of the GNU General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or (at
+//    your option) any later version.
+//
+//    conntrack-stats-exporter is distributed in the hope that it will be
+//    useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General
+//    Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License along
+//    with conntrack-stats-exporter.  If not, see
+//    <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testCA is a certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue returns a certificate and its key in PEM for the DNS name, usable by
+// servers and clients.
+func (ca *testCA) issue(t *testing.T, dnsName string) (certPEM, keyPEM string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// client returns an HTTPS client trusting ca, with the client certificate of
+// the DNS name, if any.
+func (ca *testCA) client(t *testing.T, clientCA *testCA, dnsName string) *http.Client {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	cfg := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+	if clientCA != nil {
+		certPEM, keyPEM := clientCA.issue(t, dnsName)
+
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+}
+
+// serveWeb serves with the web configuration file in dir over HTTPS and
+// returns the web server and its URL.
+func serveWeb(t *testing.T, dir string) (*webServer, string) {
+	t.Helper()
+
+	web, err := newWebServer(filepath.Join(dir, "web.yaml"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler:           web.handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		TLSConfig:         web.tlsConfig(),
+		ReadHeaderTimeout: time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.DiscardHandler, slog.LevelError),
+	}
+
+	go func() { _ = srv.ServeTLS(l, "", "") }()
+
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return web, "https://" + l.Addr().String() + "/"
+}
+
+// get returns the status code of a GET of url, or 0 on error.
+func get(t *testing.T, client *http.Client, url, user, password string) int {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0
+	}
+
+	_ = resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// bcryptHash returns the bcrypt hash of password.
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(hash)
+}
+
+func TestWebTLSAndBasicAuth(t *testing.T) {
+	var (
+		dir             = t.TempDir()
+		ca              = newTestCA(t)
+		certPEM, keyPEM = ca.issue(t, "localhost")
+	)
+
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+	writeFile(t, dir, "web.yaml", `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+basic_auth_users:
+  alice: `+bcryptHash(t, "secret")+`
+`)
+
+	_, url := serveWeb(t, dir)
+
+	client := ca.client(t, nil, "")
+
+	for _, tc := range []struct {
+		name           string
+		user, password string
+		want           int
+	}{
+		{"right password", "alice", "secret", http.StatusOK},
+		{"right password again, cached", "alice", "secret", http.StatusOK},
+		{"wrong password", "alice", "wrong", http.StatusUnauthorized},
+		{"unknown user", "bob", "secret", http.StatusUnauthorized},
+		{"no credentials", "", "", http.StatusUnauthorized},
+	} {
+		if code := get(t, client, url, tc.user, tc.password); code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, code)
+		}
+	}
+
+	if code := get(t, newTestCA(t).client(t, nil, ""), url, "alice", "secret"); code != 0 {
+		t.Errorf("expected the handshake to fail for a client not trusting the CA, got %d", code)
+	}
+
+	plainURL := strings.Replace(url, "https", "http", 1)
+
+	if code := get(t, http.DefaultClient, plainURL, "alice", "secret"); code == http.StatusOK {
+		t.Error("expected plain HTTP to fail")
+	}
+}
+
+func TestWebClientCert(t *testing.T) {
+	var (
+		dir             = t.TempDir()
+		ca              = newTestCA(t)
+		certPEM, keyPEM = ca.issue(t, "localhost")
+	)
+
+	writeFile(t, dir, "ca.crt", ca.pem)
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+	writeFile(t, dir, "web.yaml", `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+  client_allowed_sans: [prometheus.example.com]
+`)
+
+	_, url := serveWeb(t, dir)
+
+	for _, tc := range []struct {
+		name     string
+		clientCA *testCA
+		dnsName  string
+		want     int
+	}{
+		{"allowed client certificate", ca, "prometheus.example.com", http.StatusOK},
+		{"no client certificate", nil, "", 0},
+		{"client certificate of another CA", newTestCA(t), "prometheus.example.com", 0},
+		{"client certificate of a SAN not allowed", ca, "other.example.com", 0},
+	} {
+		if code := get(t, ca.client(t, tc.clientCA, tc.dnsName), url, "", ""); code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, code)
+		}
+	}
+}
+
+func TestWebReload(t *testing.T) {
+	var (
+		dir             = t.TempDir()
+		oldCA, newCA    = newTestCA(t), newTestCA(t)
+		certPEM, keyPEM = oldCA.issue(t, "localhost")
+		config          = "tls_server_config: {cert_file: server.crt, key_file: server.key}\n"
+	)
+
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+	writeFile(t, dir, "web.yaml", config)
+
+	web, url := serveWeb(t, dir)
+
+	if code := get(t, oldCA.client(t, nil, ""), url, "", ""); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	certPEM, keyPEM = newCA.issue(t, "localhost")
+
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+
+	web.reload()
+
+	if code := get(t, newCA.client(t, nil, ""), url, "", ""); code != http.StatusOK {
+		t.Errorf("expected 200 for the new certificate, got %d", code)
+	}
+
+	if code := get(t, oldCA.client(t, nil, ""), url, "", ""); code != 0 {
+		t.Errorf("expected the old certificate to be replaced, got %d", code)
+	}
+
+	writeFile(t, dir, "web.yaml", config+"basic_auth_users: {alice: "+bcryptHash(t, "secret")+"}\n")
+
+	web.reload()
+
+	if code := get(t, newCA.client(t, nil, ""), url, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after adding users, got %d", code)
+	}
+
+	writeFile(t, dir, "server.key", "invalid")
+
+	web.reload()
+
+	if code := get(t, newCA.client(t, nil, ""), url, "alice", "secret"); code != http.StatusOK {
+		t.Errorf("expected the previous configuration to be kept for invalid files, got %d", code)
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	var (
+		dir             = t.TempDir()
+		ca              = newTestCA(t)
+		certPEM, keyPEM = ca.issue(t, "localhost")
+		tlsConfig       = "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n"
+	)
+
+	writeFile(t, dir, "ca.crt", ca.pem)
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"basic auth only", "basic_auth_users: {alice: " + bcryptHash(t, "secret") + "}\n", true},
+		{"tls", tlsConfig + "  min_version: TLS13\n  cipher_suites: [TLS_AES_128_GCM_SHA256]\n", true},
+		{"invalid bcrypt hash", "basic_auth_users: {alice: secret}\n", false},
+		{"missing key_file", "tls_server_config: {cert_file: server.crt}\n", false},
+		{"unknown tls version", tlsConfig + "  min_version: TLS14\n", false},
+		{"unknown cipher suite", tlsConfig + "  cipher_suites: [TLS_NULL]\n", false},
+		{"invalid client_auth_type", tlsConfig + "  client_auth_type: Maybe\n", false},
+		{"verification without client_ca_file", tlsConfig + "  client_auth_type: VerifyClientCertIfGiven\n", false},
+		{"client_ca_file without verification", tlsConfig + "  client_ca_file: ca.crt\n", false},
+		{"client_allowed_sans without verification", tlsConfig + "  client_allowed_sans: [a]\n", false},
+		{"misspelled basic_auth_users", "basic_auth_user: {alice: " + bcryptHash(t, "secret") + "}\n", false},
+		{"misspelled tls_server_config", "tls_server_conifg: {cert_file: server.crt, key_file: server.key}\n", false},
+		{"misspelled client_auth_type", tlsConfig + "  client_auth: RequireAndVerifyClientCert\n", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadWebConfig(writeFile(t, dir, "web.yaml", tc.content), slog.New(slog.DiscardHandler))
+			if tc.valid && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+
+			if !tc.valid && err == nil {
+				t.Error("expected an error, got none")
+			}
+		})
+	}
+}
+
+func TestLoadWebConfigUnsupported(t *testing.T) {
+	var (
+		dir             = t.TempDir()
+		certPEM, keyPEM = newTestCA(t).issue(t, "localhost")
+		logs            strings.Builder
+	)
+
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+
+	path := writeFile(t, dir, "web.yaml", `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  curve_preferences: [X25519]
+  prefer_server_cipher_suites: true
+http_server_config:
+  http2: false
+`)
+
+	w, err := loadWebConfig(path, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatalf("expected unsupported settings to be ignored, got %v", err)
+	}
+
+	if w.tls == nil {
+		t.Error("expected the supported settings to be loaded")
+	}
+
+	const want = "settings=tls_server_config.curve_preferences,tls_server_config.prefer_server_cipher_suites," +
+		"http_server_config"
+
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("expected a warning naming the unsupported settings, got %q", logs.String())
+	}
+}